@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func IsZip(fileName string) bool {
+	return strings.HasSuffix(strings.ToLower(fileName), ".zip")
+}
+
+func IsGzip(fileName string) bool {
+	return strings.HasSuffix(strings.ToLower(fileName), ".gz")
+}
+
+func IsArchive(fileName string) bool {
+	return IsZip(fileName) || IsGzip(fileName)
+}
+
+// ExtractArchive unpacks a zip or gzip file into dir, returning the paths of the files written
+func ExtractArchive(archive string, dir string) ([]string, error) {
+	if IsZip(archive) {
+		return extractZip(archive, dir)
+	} else if IsGzip(archive) {
+		return extractGzip(archive, dir)
+	}
+	return nil, fmt.Errorf("unsupported archive format for %s", archive)
+}
+
+// safeJoin joins an archive entry name onto dir, rejecting names that would escape it (zip-slip)
+func safeJoin(dir string, name string) (string, error) {
+	target := filepath.Join(dir, name)
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("illegal file path in archive: %s", name)
+	}
+	return target, nil
+}
+
+func extractZip(archive string, dir string) ([]string, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	written := make([]string, 0, len(r.File))
+	for _, f := range r.File {
+		target, err := safeJoin(dir, f.Name)
+		if err != nil {
+			return written, err
+		}
+		if f.FileInfo().IsDir() {
+			err = makeDirs(dir, path.Clean(f.Name))
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		err = makeDirs(dir, path.Dir(path.Clean(f.Name)))
+		if err != nil {
+			return written, err
+		}
+		in, err := f.Open()
+		if err != nil {
+			return written, err
+		}
+		err = writeFile(target, in)
+		_ = in.Close()
+		if err != nil {
+			return written, err
+		}
+		written = append(written, target)
+	}
+	return written, nil
+}
+
+func extractGzip(archive string, dir string) ([]string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	in, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	name := filepath.Base(archive)
+	target := filepath.Join(dir, name[:len(name)-len(filepath.Ext(name))])
+	err = writeFile(target, in)
+	if err != nil {
+		return nil, err
+	}
+	return []string{target}, nil
+}
+
+// writeFile copies r into a temp file and renames it into place once complete
+func writeFile(target string, r io.Reader) error {
+	partName := target + PartialFileSuffix
+	out, err := os.OpenFile(partName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(partName)
+		return err
+	}
+	return os.Rename(partName, target)
+}
+
+// OpenCSV opens the CSV data in a downloaded extract, which may be a zip containing a CSV file, a gzipped CSV or a
+// plain CSV file
+func OpenCSV(fileName string) (io.ReadCloser, error) {
+	if IsZip(fileName) {
+		r, err := zip.OpenReader(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range r.File {
+			if strings.HasSuffix(strings.ToLower(f.Name), ".csv") {
+				in, err := f.Open()
+				if err != nil {
+					_ = r.Close()
+					return nil, err
+				}
+				return &readCloser{Reader: in, closers: []io.Closer{in, r}}, nil
+			}
+		}
+		_ = r.Close()
+		return nil, fmt.Errorf("no csv file found in %s", fileName)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if IsGzip(fileName) {
+		in, err := gzip.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: in, closers: []io.Closer{in, f}}, nil
+	}
+	return f, nil
+}
+
+// BaseName strips archive and csv extensions from a file name, e.g. stnet_2022-05-01.zip and
+// fixed_export_2022-05-01.csv.gz both become the name before the extensions
+func BaseName(fileName string) string {
+	name := filepath.Base(fileName)
+	for _, ext := range []string{".gz", ".zip", ".csv"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			name = name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeZip(t *testing.T, fileName string, entries map[string]string) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, contents := range entries {
+		f, err := w.Create(name)
+		assert.Nil(t, err)
+		_, _ = f.Write([]byte(contents))
+	}
+	assert.Nil(t, w.Close())
+	assert.Nil(t, os.WriteFile(fileName, buf.Bytes(), 0644))
+}
+
+func TestExtractArchive(t *testing.T) {
+	t.Run("should unpack zip files", func(t *testing.T) {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "stnet_2022-05-01.zip")
+		writeZip(t, archive, map[string]string{"stnet_2022-05-01.csv": "a,b\n1,2\n", "docs/readme.txt": "hello"})
+		written, err := ExtractArchive(archive, dir)
+		assert.Nil(t, err)
+		assert.Len(t, written, 2)
+		contents, _ := os.ReadFile(filepath.Join(dir, "stnet_2022-05-01.csv"))
+		assert.Equal(t, "a,b\n1,2\n", string(contents))
+		assert.FileExists(t, filepath.Join(dir, "docs", "readme.txt"))
+	})
+
+	t.Run("should reject entries outside the target directory", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "target")
+		archive := filepath.Join(dir, "evil.zip")
+		writeZip(t, archive, map[string]string{"../evil.txt": "gotcha"})
+		_, err := ExtractArchive(archive, target)
+		assert.NotNil(t, err)
+		assert.NoFileExists(t, filepath.Join(dir, "evil.txt"))
+	})
+
+	t.Run("should unpack gzip files", func(t *testing.T) {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "fixed_export_2022-05-01.csv.gz")
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, _ = w.Write([]byte("a,b\n1,2\n"))
+		assert.Nil(t, w.Close())
+		assert.Nil(t, os.WriteFile(archive, buf.Bytes(), 0644))
+
+		written, err := ExtractArchive(archive, dir)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "fixed_export_2022-05-01.csv")}, written)
+	})
+}
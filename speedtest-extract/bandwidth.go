@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"io"
+	"sync"
+	"time"
+)
+
+// minBurst allows reads of a reasonable size even at very low rates
+const minBurst = 32 * 1024
+
+// RateWindow sets the download rate limit for a time of day, e.g. to allow faster downloads overnight. Windows where
+// end is before start wrap around midnight.
+type RateWindow struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	Limit string `yaml:"limit"`
+}
+
+type rateWindow struct {
+	start int
+	end   int
+	limit int64
+}
+
+// BandwidthLimiter is a token bucket shared by all download workers, so the limit applies to the combined rate
+type BandwidthLimiter struct {
+	limiter  *rate.Limiter
+	base     int64
+	schedule []rateWindow
+
+	mu      sync.Mutex
+	current int64
+}
+
+// parseTimeOfDay returns the minutes since midnight for a time given as HH:MM
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// NewBandwidthLimiter creates a limiter for the base rate in bytes per second, adjusted by the schedule. A rate of zero
+// is unlimited. Returns nil when there is nothing to limit.
+func NewBandwidthLimiter(base int64, schedule []RateWindow) (*BandwidthLimiter, error) {
+	if base <= 0 && len(schedule) == 0 {
+		return nil, nil
+	}
+	b := &BandwidthLimiter{base: base, current: -1}
+	for _, w := range schedule {
+		start, err := parseTimeOfDay(w.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(w.End)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := ParseSize(w.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q in schedule: %w", w.Limit, err)
+		}
+		b.schedule = append(b.schedule, rateWindow{start: start, end: end, limit: limit})
+	}
+	b.limiter = rate.NewLimiter(rate.Inf, minBurst)
+	b.refresh(time.Now())
+	return b, nil
+}
+
+// LimitAt returns the limit in bytes per second in effect at the given time, zero being unlimited. The first matching
+// window in the schedule wins, falling back to the base limit.
+func (b *BandwidthLimiter) LimitAt(now time.Time) int64 {
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range b.schedule {
+		inWindow := minute >= w.start && minute < w.end
+		if w.end <= w.start {
+			inWindow = minute >= w.start || minute < w.end
+		}
+		if inWindow {
+			return w.limit
+		}
+	}
+	return b.base
+}
+
+func (b *BandwidthLimiter) refresh(now time.Time) {
+	limit := b.LimitAt(now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit == b.current {
+		return
+	}
+	b.current = limit
+	if limit <= 0 {
+		b.limiter.SetLimitAt(now, rate.Inf)
+	} else {
+		b.limiter.SetLimitAt(now, rate.Limit(limit))
+		b.limiter.SetBurstAt(now, int(max(limit, minBurst)))
+	}
+}
+
+// Reader limits the rate data is read from r. Returns r unchanged when the limiter is nil.
+func (b *BandwidthLimiter) Reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &limitedReader{reader: r, limiter: b}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	r.limiter.refresh(time.Now())
+	burst := r.limiter.limiter.Burst()
+	if len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.reader.Read(p)
+	//the schedule may have lowered the burst during the read, wait for the bytes in chunks that still fit within it
+	for remaining := n; remaining > 0; {
+		chunk := min(remaining, r.limiter.limiter.Burst())
+		if waitErr := r.limiter.limiter.WaitN(context.Background(), chunk); waitErr != nil {
+			if err == nil {
+				err = waitErr
+			}
+			break
+		}
+		remaining -= chunk
+	}
+	return n, err
+}
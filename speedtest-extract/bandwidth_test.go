@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	t.Run("should parse sizes", func(t *testing.T) {
+		for value, expected := range map[string]int64{"": 0, "0": 0, "512": 512, "500K": 500 * 1024, "50M": 50 * 1024 * 1024, "1.5GiB": 3 * 512 * 1024 * 1024, "2gb": 2 * 1024 * 1024 * 1024, "10B": 10, "64 KB": 64 * 1024, "0.5K": 512, "0.0": 0, "7E": 7 << 60} {
+			size, err := ParseSize(value)
+			assert.Nil(t, err, value)
+			assert.Equal(t, expected, size, value)
+		}
+		for _, value := range []string{"fast", "50Q", "10MBx", "10I", "1e5", "inf", "-1", "M", "8E", "9E", "0.5", "0.9B"} {
+			_, err := ParseSize(value)
+			assert.NotNil(t, err, value)
+		}
+	})
+
+	t.Run("should apply the schedule by time of day", func(t *testing.T) {
+		limiter, err := NewBandwidthLimiter(1024, []RateWindow{
+			{Start: "22:00", End: "06:00", Limit: "1M"},
+			{Start: "12:00", End: "13:00", Limit: "0"},
+		})
+		assert.Nil(t, err)
+		day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.Local)
+		assert.Equal(t, int64(1024*1024), limiter.LimitAt(day.Add(23*time.Hour)))
+		assert.Equal(t, int64(1024*1024), limiter.LimitAt(day.Add(5*time.Hour+59*time.Minute)))
+		assert.Equal(t, int64(1024), limiter.LimitAt(day.Add(6*time.Hour)))
+		assert.Equal(t, int64(0), limiter.LimitAt(day.Add(12*time.Hour+30*time.Minute)))
+
+		_, err = NewBandwidthLimiter(0, []RateWindow{{Start: "10pm", End: "06:00", Limit: "1M"}})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("should limit the rate data is read", func(t *testing.T) {
+		limiter, err := NewBandwidthLimiter(64*1024, nil)
+		assert.Nil(t, err)
+		start := time.Now()
+		n, err := io.Copy(io.Discard, limiter.Reader(bytes.NewReader(make([]byte, 96*1024))))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(96*1024), n)
+		//the first 64K is allowed as a burst, the rest takes half a second
+		assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+
+	t.Run("should wait within the burst when it is lowered during a read", func(t *testing.T) {
+		limiter, err := NewBandwidthLimiter(64*1024, nil)
+		assert.Nil(t, err)
+		lowered := readerFunc(func(p []byte) (int, error) {
+			limiter.limiter.SetBurst(1024)
+			return len(p), nil
+		})
+		n, err := limiter.Reader(lowered).Read(make([]byte, 4*1024))
+		assert.Equal(t, 4*1024, n)
+		assert.Nil(t, err)
+	})
+
+	t.Run("should not limit without a rate or schedule", func(t *testing.T) {
+		limiter, err := NewBandwidthLimiter(0, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, limiter)
+		r := bytes.NewReader(nil)
+		assert.Equal(t, io.Reader(r), limiter.Reader(r))
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/jedib0t/go-pretty/v6/table"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	ChecksumSha256 = "sha256"
+	ChecksumMd5    = "md5"
+)
+
+// ChecksumAlgorithms lists the supported algorithms in order of preference, each doubling as its sidecar file extension
+var ChecksumAlgorithms = []string{ChecksumSha256, ChecksumMd5}
+
+var md5ETagPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type Checksum struct {
+	Algorithm string
+	Value     string
+	Source    string
+}
+
+func (c *Checksum) String() string {
+	return fmt.Sprintf("%s:%s", c.Algorithm, c.Value)
+}
+
+// Matches compares a hex encoded digest against the checksum, ignoring case
+func (c *Checksum) Matches(digest string) bool {
+	return strings.EqualFold(c.Value, digest)
+}
+
+func NewHash(algorithm string) hash.Hash {
+	if algorithm == ChecksumSha256 {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+func HashFile(fileName string, algorithm string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := NewHash(algorithm)
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ETagChecksum interprets the ETag of a response as an md5 checksum. Only single part uploads to S3 compatible storage
+// without KMS or customer provided key encryption use the md5 of the content as the ETag, so anything else, or an ETag
+// that isn't 32 hex characters (multipart, weak, etc.), is ignored.
+func ETagChecksum(header http.Header) *Checksum {
+	etag := header.Get("ETag")
+	if len(etag) == 0 {
+		return nil
+	}
+	if encryption := header.Get("X-Amz-Server-Side-Encryption"); strings.HasPrefix(encryption, "aws:kms") || len(header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm")) > 0 {
+		log.Debug(fmt.Sprintf("ignoring etag %s of an encrypted object, it isn't an md5 of the content", etag))
+		return nil
+	}
+	value := strings.ToLower(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`))
+	if strings.HasPrefix(etag, "W/") || !md5ETagPattern.MatchString(value) {
+		log.Debug(fmt.Sprintf("ignoring etag %s, it isn't an md5 of the content", etag))
+		return nil
+	}
+	return &Checksum{Algorithm: ChecksumMd5, Value: value, Source: "etag"}
+}
+
+// ExpectedChecksum returns the checksum published for the item, either as part of the index or as a sidecar file.
+// Returns nil when the server doesn't provide one.
+func (e *ExtractItem) ExpectedChecksum(client *resty.Client) (*Checksum, error) {
+	if len(e.Sha256) > 0 {
+		return &Checksum{Algorithm: ChecksumSha256, Value: e.Sha256, Source: "index"}, nil
+	}
+	if len(e.Md5) > 0 {
+		return &Checksum{Algorithm: ChecksumMd5, Value: e.Md5, Source: "index"}, nil
+	}
+	for _, algorithm := range ChecksumAlgorithms {
+		sidecar, ok := e.Sidecars[algorithm]
+		if !ok {
+			continue
+		}
+		resp, err := client.R().Get(sidecar.Url)
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("unexpected status retrieving %s: %s", sidecar.Name, resp.Status())
+		}
+		//sidecars use the coreutils format of "<digest>  <filename>", the digest alone is also accepted
+		fields := strings.Fields(resp.String())
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty checksum file %s", sidecar.Name)
+		}
+		return &Checksum{Algorithm: algorithm, Value: fields[0], Source: sidecar.Name}, nil
+	}
+	return nil, nil
+}
+
+// RemoteChecksum returns the expected checksum for the item, falling back to the ETag reported by the server when the
+// index has none. Only the first byte is requested since signed download urls generally don't allow HEAD requests.
+func (e *ExtractItem) RemoteChecksum(client *resty.Client) (*Checksum, error) {
+	checksum, err := e.ExpectedChecksum(client)
+	if err != nil || checksum != nil {
+		return checksum, err
+	}
+	resp, err := client.R().
+		SetDoNotParseResponse(true).
+		SetHeader("Range", "bytes=0-0").
+		Get(e.Url)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.RawBody().Close()
+	if resp.IsError() {
+		return nil, fmt.Errorf("unexpected status retrieving %s: %s", e.Name, resp.Status())
+	}
+	return ETagChecksum(resp.Header()), nil
+}
+
+// IsChecksumFile reports whether the item is a sidecar file holding the checksum of another file
+func (e *ExtractItem) IsChecksumFile() bool {
+	_, algorithm := e.checksumTarget()
+	return len(algorithm) > 0
+}
+
+func (e *ExtractItem) checksumTarget() (string, string) {
+	for _, algorithm := range ChecksumAlgorithms {
+		if target, ok := strings.CutSuffix(e.Name, "."+algorithm); ok {
+			return target, algorithm
+		}
+	}
+	return "", ""
+}
+
+// VerifyFiles re-hashes the downloaded copies of the given files and compares them to the checksums published by the
+// server, reporting the result for each file. Files that haven't been downloaded are ignored, and a file that can't be
+// checked is reported as failed without stopping the others.
+func VerifyFiles(files []ExtractFile, client *resty.Client, useFileHierarchy bool) error {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"File", "Path", "Checksum", "Status"})
+	verified, mismatched, unavailable, failed := 0, 0, 0, 0
+	for _, f := range files {
+		fileName, err := f.LocalPath(useFileHierarchy)
+		if err != nil {
+			t.AppendRow(table.Row{f.Name, "", "", fmt.Sprintf("FAIL (%s)", err)})
+			failed += 1
+			continue
+		}
+		if _, err := os.Stat(fileName); err != nil {
+			log.Debug(fmt.Sprintf("%s not found at %s, skipping", f.Name, fileName))
+			continue
+		}
+		status := "ok"
+		checksum, err := f.Item.RemoteChecksum(client)
+		if err != nil {
+			log.WithError(err).Debug(fmt.Sprintf("unable to retrieve the checksum of %s", f.Name))
+			status = fmt.Sprintf("FAIL (%s)", err)
+			failed += 1
+		} else if checksum == nil {
+			status = "no checksum available"
+			unavailable += 1
+		} else {
+			log.Debug(fmt.Sprintf("verifying %s against %s from %s", fileName, checksum, checksum.Source))
+			digest, err := HashFile(fileName, checksum.Algorithm)
+			if err != nil {
+				status = fmt.Sprintf("FAIL (%s)", err)
+				failed += 1
+			} else if checksum.Matches(digest) {
+				verified += 1
+			} else {
+				status = fmt.Sprintf("MISMATCH (received %s)", digest)
+				mismatched += 1
+			}
+		}
+		checksumValue := ""
+		if checksum != nil {
+			checksumValue = checksum.String()
+		}
+		t.AppendRow(table.Row{f.Name, fileName, checksumValue, status})
+	}
+	if verified+mismatched+unavailable+failed == 0 {
+		return ErrNoDownloadedFiles
+	}
+	t.Render()
+	log.Info(fmt.Sprintf("Verified %d file(s), %d mismatch(es), %d without a checksum, %d failed", verified, mismatched, unavailable, failed))
+	if mismatched > 0 {
+		return fmt.Errorf("%w in %d file(s)", ErrChecksumMismatch, mismatched)
+	} else if failed > 0 {
+		return fmt.Errorf("unable to verify %d file(s)", failed)
+	}
+	return nil
+}
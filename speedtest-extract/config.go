@@ -1,17 +1,43 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"os"
+	"path/filepath"
 )
 
 type Config struct {
-	ApiKey               string `yaml:"api_key"`
-	ApiSecret            string `yaml:"api_secret"`
+	ApiKey    string `yaml:"api_key"`
+	ApiSecret string `yaml:"api_secret"`
+	//ApiSecretFile and ApiSecretCommand read the secret from a file or the output of a command instead of api_secret
+	ApiSecretFile        string `yaml:"api_secret_file,omitempty"`
+	ApiSecretCommand     string `yaml:"api_secret_command,omitempty"`
 	ExtractUrl           string `yaml:"extract_url"`
 	StorageDirectory     string `yaml:"storage_directory"`
 	CacheFilename        string `yaml:"cache_filename"`
 	CacheDurationMinutes int    `yaml:"cache_duration_minutes"`
+	StateFilename        string `yaml:"state_filename"`
+	//PathTemplate lays out downloaded files in place of --use-file-hierarchy
+	PathTemplate string `yaml:"path_template,omitempty"`
+	//Storage stores downloads somewhere other than the storage directory, e.g. an S3 bucket
+	Storage      *StorageConfig `yaml:"storage,omitempty"`
+	LimitRate    string         `yaml:"limit_rate,omitempty"`
+	RateSchedule []RateWindow   `yaml:"rate_schedule,omitempty"`
+	//ColumnTypes overrides the inferred column types when converting, keyed by dataset then column name
+	ColumnTypes map[string]map[string]string `yaml:"column_types,omitempty"`
+	//LoadDsn is the database the load command writes to, e.g. sqlite://extracts.db or postgres://user@host/db
+	LoadDsn string `yaml:"load_dsn,omitempty"`
+
+	IndexRetry    *RetryPolicy `yaml:"index_retry,omitempty"`
+	DownloadRetry *RetryPolicy `yaml:"download_retry,omitempty"`
+
+	//Profiles are named accounts that override the values above, chosen with --profile
+	Profiles map[string]*Profile `yaml:"profiles,omitempty"`
+	//Profile is the name of the profile these values were read for, if any
+	Profile string `yaml:"-"`
+	//sources records the layer that supplied each value set by something other than the defaults
+	sources map[string]string
 }
 
 var DefaultConfig = Config{
@@ -21,11 +47,35 @@ var DefaultConfig = Config{
 	StorageDirectory:     ".",
 	CacheFilename:        ".extracts-cache.json",
 	CacheDurationMinutes: -1,
+	StateFilename:        ".extracts-state.json",
+	IndexRetry:           &DefaultIndexRetry,
+	DownloadRetry:        &DefaultDownloadRetry,
 }
 
 var DefaultConfigFile = "speedtest-extract.yaml"
 
-func ReadConfig(configFile string) (*Config, error) {
+// ReadConfig reads the config file, applying the overrides of the named profile unless it's empty, then the
+// environment variables and the given layers in turn
+func ReadConfig(configFile string, profile string, layers ...ConfigLayer) (*Config, error) {
+	config, err := parseConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return config.ForProfile(profile, configFile, append([]ConfigLayer{EnvLayer()}, layers...)...)
+}
+
+// ReadConfigWithoutFile builds the config from the defaults and the environment variables and given layers alone, for
+// running without a config file, e.g. in a container. Relative paths such as the state file are kept next to where the
+// config file would be.
+func ReadConfigWithoutFile(configFile string, profile string, layers ...ConfigLayer) (*Config, error) {
+	if len(profile) > 0 {
+		return nil, fmt.Errorf("profile %s requires a config file, %s not found", profile, configFile)
+	}
+	var config Config
+	return config.ForProfile("", configFile, append([]ConfigLayer{EnvLayer()}, layers...)...)
+}
+
+func parseConfig(configFile string) (*Config, error) {
 	contents, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
@@ -35,12 +85,15 @@ func ReadConfig(configFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.setFileSources(contents)
+	return &config, nil
+}
 
-	if len(config.ApiKey) == 0 || len(config.ApiSecret) == 0 {
-		return nil, ErrMissingAuth
-	}
-	if config.ApiKey == DefaultConfig.ApiKey || config.ApiSecret == DefaultConfig.ApiSecret {
-		return nil, ErrDefaultConfig
+// resolve fills in the credentials and the default for every value that isn't set
+func (config *Config) resolve(configFile string) error {
+	err := ResolveCredentials(config, configFile)
+	if err != nil {
+		return err
 	}
 	if len(config.ExtractUrl) == 0 {
 		config.ExtractUrl = DefaultConfig.ExtractUrl
@@ -54,18 +107,59 @@ func ReadConfig(configFile string) (*Config, error) {
 	if config.CacheDurationMinutes == 0 {
 		config.CacheDurationMinutes = DefaultConfig.CacheDurationMinutes
 	}
-
-	return &config, nil
+	if len(config.StateFilename) == 0 {
+		config.StateFilename = DefaultConfig.StateFilename
+	}
+	//the state file lives next to the config file unless an absolute path is given
+	if !filepath.IsAbs(config.StateFilename) {
+		config.StateFilename = filepath.Join(filepath.Dir(configFile), config.StateFilename)
+	}
+	config.IndexRetry = config.IndexRetry.WithDefaults(DefaultIndexRetry)
+	config.DownloadRetry = config.DownloadRetry.WithDefaults(DefaultDownloadRetry)
+	return nil
 }
 
-func WriteConfig() error {
-	configYaml, err := yaml.Marshal(DefaultConfig)
+// writeConfigFile writes the config to a file readable only by the current user, since it may hold credentials
+func writeConfigFile(configFile string, c Config) error {
+	configYaml, err := yaml.Marshal(c)
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(DefaultConfigFile, configYaml, 0600)
+	err = makeDirPath(filepath.Dir(configFile))
 	if err != nil {
 		return err
 	}
-	return nil
+	return os.WriteFile(configFile, configYaml, 0600)
+}
+
+// WriteConfig writes the default config to configFile, creating its directory if needed
+func WriteConfig(configFile string) error {
+	return writeConfigFile(configFile, DefaultConfig)
+}
+
+// ConfigSearchPaths are where the config file is looked for when --config isn't given, in order: the current
+// directory, $XDG_CONFIG_HOME/speedtest-extract (~/.config/speedtest-extract if unset) and /etc/speedtest-extract
+func ConfigSearchPaths() []string {
+	paths := []string{DefaultConfigFile}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if len(configHome) == 0 {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if len(configHome) > 0 {
+		paths = append(paths, filepath.Join(configHome, "speedtest-extract", DefaultConfigFile))
+	}
+	return append(paths, filepath.Join("/etc", "speedtest-extract", DefaultConfigFile))
+}
+
+// findConfigFile returns the first of the paths that exists, or the first path if none of them do so that a new
+// config file is written to the current directory
+func findConfigFile(paths []string) string {
+	for _, p := range paths {
+		if fileExists(p) {
+			return p
+		}
+	}
+	return paths[0]
 }
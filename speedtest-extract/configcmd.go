@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// redacted replaces secrets in the output of config show
+const redacted = "REDACTED"
+
+// validateFileName is written to the storage and removed again to check that files can be stored
+const validateFileName = ".speedtest-extract-validate"
+
+// ConfigCheck is the result of checking one part of the config
+type ConfigCheck struct {
+	Name string
+	Err  error
+}
+
+// ConfigInit prompts for the credentials and storage directory, checks them against the api and writes a new config
+// file with them
+func ConfigInit(context *cli.Context) error {
+	configFile := ConfigFile(context)
+	if fileExists(configFile) && !context.Bool("force") {
+		return fmt.Errorf("%s already exists, re-run with --force to replace it", configFile)
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	c := DefaultConfig
+	var err error
+	c.ApiKey, err = promptText(in, "API key", "")
+	if err != nil {
+		return err
+	}
+	c.ApiSecret, err = promptSecret(in, "API secret")
+	if err != nil {
+		return err
+	}
+	c.StorageDirectory, err = promptText(in, "Storage directory", DefaultConfig.StorageDirectory)
+	if err != nil {
+		return err
+	}
+
+	err = checkStorageDirectory(c.StorageDirectory, true)
+	if err != nil {
+		return err
+	}
+	if !context.Bool("skip-check") {
+		config = c
+		err = CheckCredentials()
+		if err != nil {
+			return fmt.Errorf("unable to reach the extracts index with these credentials, re-run with --skip-check to write them anyway: %w", err)
+		}
+		fmt.Println("Credentials verified")
+	}
+
+	err = writeConfigFile(configFile, c)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", configFile)
+	return nil
+}
+
+// promptText reads a line of input, returning the default value if nothing is entered. A value is required when
+// there is no default.
+func promptText(in *bufio.Reader, prompt string, defaultValue string) (string, error) {
+	for {
+		if len(defaultValue) > 0 {
+			fmt.Printf("%s [%s]: ", prompt, defaultValue)
+		} else {
+			fmt.Printf("%s: ", prompt)
+		}
+		line, err := in.ReadString('\n')
+		value := strings.TrimSpace(line)
+		if len(value) == 0 {
+			value = defaultValue
+		}
+		if len(value) > 0 {
+			return value, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s is required", strings.ToLower(prompt))
+		}
+	}
+}
+
+// promptSecret reads a secret without echoing it when reading from a terminal
+func promptSecret(in *bufio.Reader, prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return promptText(in, prompt, "")
+	}
+	for {
+		fmt.Printf("%s: ", prompt)
+		secret, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		if value := strings.TrimSpace(string(secret)); len(value) > 0 {
+			return value, nil
+		}
+	}
+}
+
+// checkStorageDirectory checks that files can be written to the directory, creating it first if asked to
+func checkStorageDirectory(dir string, create bool) error {
+	if create {
+		err := makeDirPath(dir)
+		if err != nil {
+			return fmt.Errorf("unable to create storage directory: %w", err)
+		}
+	}
+	stats, err := os.Stat(dir)
+	if err != nil {
+		return err
+	} else if !stats.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, validateFileName)
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// ConfigValidate checks the config file, reporting every problem found rather than stopping at the first
+func ConfigValidate(context *cli.Context) error {
+	configFile := ConfigFile(context)
+	profiles, err := readConfigStrict(configFile, context.String("profile"), context.Bool("all-profiles"), FlagLayer(context))
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, c := range profiles {
+		if len(c.Profile) > 0 {
+			fmt.Printf("Profile %s\n", c.Profile)
+		}
+		for _, check := range ValidateConfig(c) {
+			if check.Err != nil {
+				problems++
+				fmt.Printf("  FAIL  %s: %s\n", check.Name, check.Err)
+			} else {
+				fmt.Printf("  ok    %s\n", check.Name)
+			}
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d problem(s) in %s", problems, configFile)
+	}
+	fmt.Printf("%s is valid\n", configFile)
+	return nil
+}
+
+// readConfigStrict reads the config file for the selected profiles, rejecting fields that aren't recognized so typos
+// don't go unnoticed
+func readConfigStrict(configFile string, profile string, all bool, layers ...ConfigLayer) ([]*Config, error) {
+	contents, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var strict Config
+	err = yaml.UnmarshalStrict(contents, &strict)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", configFile, err)
+	}
+	if all {
+		return ReadAllProfiles(configFile, layers...)
+	}
+	c, err := ReadConfig(configFile, profile, layers...)
+	if err != nil {
+		return nil, err
+	}
+	return []*Config{c}, nil
+}
+
+// ValidateConfig checks each value of the config in turn, then that the storage is writable and the extracts index
+// can be reached with the credentials
+func ValidateConfig(c *Config) []ConfigCheck {
+	checks := []ConfigCheck{
+		{Name: "extract_url", Err: validateUrl(c.ExtractUrl)},
+		{Name: "cache_filename", Err: validateParentDirectory(c.CacheFilename, c.CacheDurationMinutes > 0)},
+		{Name: "state_filename", Err: validateStateFile(c.StateFilename)},
+	}
+
+	limitRate, err := ParseSize(c.LimitRate)
+	if err == nil {
+		_, err = NewBandwidthLimiter(limitRate, c.RateSchedule)
+	}
+	checks = append(checks, ConfigCheck{Name: "limit_rate and rate_schedule", Err: err})
+
+	if len(c.PathTemplate) > 0 && c.PathTemplate != "hive" {
+		_, err = ParsePathTemplate(c.PathTemplate)
+		checks = append(checks, ConfigCheck{Name: "path_template", Err: err})
+	}
+	if len(c.ColumnTypes) > 0 {
+		checks = append(checks, ConfigCheck{Name: "column_types", Err: validateColumnTypes(c.ColumnTypes)})
+	}
+	if len(c.LoadDsn) > 0 {
+		_, _, err = parseDsn(c.LoadDsn)
+		checks = append(checks, ConfigCheck{Name: "load_dsn", Err: err})
+	}
+
+	if c.Storage == nil || len(c.Storage.Type) == 0 || c.Storage.Type == StorageLocal {
+		checks = append(checks, ConfigCheck{Name: "storage_directory", Err: checkStorageDirectory(c.StorageDirectory, false)})
+	} else {
+		checks = append(checks, ConfigCheck{Name: "storage", Err: checkStorage(*c)})
+	}
+
+	previous := config
+	config = *c
+	checks = append(checks, ConfigCheck{Name: "credentials", Err: CheckCredentials()})
+	config = previous
+	return checks
+}
+
+func validateUrl(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("%s is not an http or https url", value)
+	}
+	return nil
+}
+
+// validateParentDirectory checks that the directory a file will be written to exists
+func validateParentDirectory(fileName string, used bool) error {
+	if !used {
+		return nil
+	}
+	stats, err := os.Stat(filepath.Dir(fileName))
+	if err != nil {
+		return err
+	} else if !stats.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(fileName))
+	}
+	return nil
+}
+
+func validateStateFile(fileName string) error {
+	err := validateParentDirectory(fileName, true)
+	if err != nil {
+		return err
+	}
+	_, err = LoadState(fileName)
+	return err
+}
+
+func validateColumnTypes(columnTypes map[string]map[string]string) error {
+	for dataset, columns := range columnTypes {
+		for column, columnType := range columns {
+			if !contains(columnType, ColumnTypes) {
+				return fmt.Errorf("unknown type %q for %s.%s, expected one of %s", columnType, dataset, column, strings.Join(ColumnTypes, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// checkStorage connects to remote storage and stores and deletes a small file
+func checkStorage(c Config) error {
+	storage, err := NewStorage(c)
+	if err != nil {
+		return err
+	}
+	if closer, ok := storage.(io.Closer); ok {
+		defer closer.Close()
+	}
+	w, err := storage.Writer(validateFileName)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "speedtest-extract")
+	if err != nil {
+		_ = w.Abort()
+		return err
+	}
+	err = w.Commit()
+	if err != nil {
+		return err
+	}
+	return storage.Delete(validateFileName)
+}
+
+// ConfigShow prints the config in effect after applying the profile, environment variables, flags and defaults, with
+// secrets redacted. With --sources it lists each value with the layer that supplied it instead.
+func ConfigShow(context *cli.Context) error {
+	configFile := ConfigFile(context)
+	var profiles []*Config
+	if context.Bool("all-profiles") {
+		var err error
+		profiles, err = ReadAllProfiles(configFile, FlagLayer(context))
+		if err != nil {
+			return err
+		}
+	} else {
+		c, err := LoadConfig(context, configFile)
+		if err != nil {
+			return err
+		}
+		profiles = []*Config{c}
+	}
+
+	for i, c := range profiles {
+		if i > 0 {
+			fmt.Println("---")
+		}
+		if len(c.Profile) > 0 {
+			fmt.Printf("# profile: %s\n", c.Profile)
+		}
+		if context.Bool("sources") {
+			writeConfigSources(os.Stdout, c)
+			continue
+		}
+		out, err := yaml.Marshal(RedactConfig(*c))
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+	}
+	return nil
+}
+
+// writeConfigSources writes a table of each config value and the layer that supplied it
+func writeConfigSources(w io.Writer, c *Config) {
+	tw := table.NewWriter()
+	tw.SetOutputMirror(w)
+	tw.AppendHeader(table.Row{"Key", "Value", "Source"})
+	for _, source := range ConfigSources(c) {
+		tw.AppendRow(table.Row{source[0], source[1], source[2]})
+	}
+	tw.Render()
+}
+
+// RedactConfig returns a copy of the config with secrets replaced, and without the profiles since the config already
+// has the selected profile applied
+func RedactConfig(c Config) Config {
+	if len(c.ApiSecret) > 0 {
+		c.ApiSecret = redacted
+	}
+	if len(c.ApiSecretCommand) > 0 {
+		c.ApiSecretCommand = redacted
+	}
+	if c.Storage != nil {
+		storage := *c.Storage
+		if len(storage.SecretAccessKey) > 0 {
+			storage.SecretAccessKey = redacted
+		}
+		if len(storage.PrivateKeyPassphrase) > 0 {
+			storage.PrivateKeyPassphrase = redacted
+		}
+		c.Storage = &storage
+	}
+	c.LoadDsn = redactValue("load_dsn", c.LoadDsn)
+	c.Profiles = nil
+	return c
+}
+
+// ConfigFile returns the config file given with --config, or else the first one found on the search path
+func ConfigFile(context *cli.Context) string {
+	if context.IsSet("config") {
+		return context.String("config")
+	}
+	return findConfigFile(ConfigSearchPaths())
+}
+
+// LoadConfig reads the config file for the profile with the flags applied. When the config file wasn't given with
+// --config and isn't found, the config is built from the defaults, environment variables and flags alone.
+func LoadConfig(context *cli.Context, configFile string) (*Config, error) {
+	flags := FlagLayer(context)
+	c, err := ReadConfig(configFile, context.String("profile"), flags)
+	if os.IsNotExist(err) && !context.IsSet("config") {
+		withoutFile, envErr := ReadConfigWithoutFile(configFile, context.String("profile"), flags)
+		if errors.Is(envErr, ErrMissingAuth) || errors.Is(envErr, ErrDefaultConfig) {
+			//without credentials the config file is needed after all
+			return nil, err
+		}
+		return withoutFile, envErr
+	}
+	return c, err
+}
+
+// isConfigCommand is true when running one of the config commands, which handle the config file themselves
+func isConfigCommand(context *cli.Context) bool {
+	return context.Args().First() == "config"
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const ConvertParquet = "parquet"
+
+var ConvertFormats = []string{ConvertParquet}
+
+const (
+	ColumnInt64   = "int64"
+	ColumnDouble  = "double"
+	ColumnBoolean = "boolean"
+	ColumnString  = "string"
+)
+
+var ColumnTypes = []string{ColumnInt64, ColumnDouble, ColumnBoolean, ColumnString}
+
+// inferenceRows is the number of rows read to infer column types before writing starts
+const inferenceRows = 1000
+
+var columnNamePattern = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// Column describes a CSV column and the type its values are converted to
+type Column struct {
+	Name string
+	Type string
+}
+
+// CsvTable reads a CSV file whose column types are inferred from the first rows, or taken from the configured types
+type CsvTable struct {
+	Columns []Column
+	reader  *csv.Reader
+	sample  [][]string
+}
+
+// NewCsvTable reads the header and enough rows to infer the column types. configured maps column names to one of
+// ColumnTypes and takes precedence over inference.
+func NewCsvTable(r io.Reader, configured map[string]string) (*CsvTable, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = false
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read csv header: %w", err)
+	}
+	t := &CsvTable{reader: reader}
+	for len(t.sample) < inferenceRows {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		t.sample = append(t.sample, row)
+	}
+	for i, name := range header {
+		columnType, ok := configured[name]
+		if ok && !contains(columnType, ColumnTypes) {
+			return nil, fmt.Errorf("unknown type %q for column %s, expected one of %s", columnType, name, strings.Join(ColumnTypes, ", "))
+		} else if !ok {
+			columnType = inferColumnType(t.sample, i)
+		}
+		t.Columns = append(t.Columns, Column{Name: name, Type: columnType})
+	}
+	return t, nil
+}
+
+// inferColumnType picks the narrowest type that every non-empty value in the column can be parsed as
+func inferColumnType(rows [][]string, column int) string {
+	isInt, isDouble, isBool, seen := true, true, true, false
+	for _, row := range rows {
+		if column >= len(row) || len(row[column]) == 0 {
+			continue
+		}
+		seen = true
+		value := row[column]
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			isInt = false
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			isDouble = false
+		}
+		if _, err := strconv.ParseBool(value); err != nil || !strings.ContainsAny(value, "tfTF") {
+			isBool = false
+		}
+	}
+	switch {
+	case !seen:
+		return ColumnString
+	case isInt:
+		return ColumnInt64
+	case isDouble:
+		return ColumnDouble
+	case isBool:
+		return ColumnBoolean
+	}
+	return ColumnString
+}
+
+// Next returns the next row converted to the column types, with empty values as nil. Returns io.EOF at the end.
+func (t *CsvTable) Next() ([]interface{}, error) {
+	var row []string
+	if len(t.sample) > 0 {
+		row, t.sample = t.sample[0], t.sample[1:]
+	} else {
+		var err error
+		row, err = t.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+	}
+	values := make([]interface{}, len(t.Columns))
+	for i, c := range t.Columns {
+		if i >= len(row) || len(row[i]) == 0 {
+			continue
+		}
+		value, err := ConvertValue(row[i], c.Type)
+		if err != nil {
+			line, _ := t.reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d, column %s: %w. set the column type with column_types in the config file", line, c.Name, err)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func ConvertValue(value string, columnType string) (interface{}, error) {
+	switch columnType {
+	case ColumnInt64:
+		return strconv.ParseInt(value, 10, 64)
+	case ColumnDouble:
+		return strconv.ParseFloat(value, 64)
+	case ColumnBoolean:
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+// ConvertedPath returns the name of the converted file, keeping the dataset and date naming of the extract, e.g.
+// stnet_2022-05-01.zip becomes stnet_2022-05-01.parquet
+func ConvertedPath(fileName string, format string) string {
+	return filepath.Join(filepath.Dir(fileName), BaseName(fileName)+"."+format)
+}
+
+func parquetSchema(columns []Column) []string {
+	md := make([]string, 0, len(columns))
+	for _, c := range columns {
+		name := columnNamePattern.ReplaceAllString(c.Name, "_")
+		var definition string
+		switch c.Type {
+		case ColumnInt64:
+			definition = "type=INT64"
+		case ColumnDouble:
+			definition = "type=DOUBLE"
+		case ColumnBoolean:
+			definition = "type=BOOLEAN"
+		default:
+			definition = "type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"
+		}
+		md = append(md, fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", name, definition))
+	}
+	return md
+}
+
+// ConvertToParquet streams the CSV data from a downloaded extract into a parquet file. The file is written to a temp
+// file and renamed once complete.
+func ConvertToParquet(source string, dest string, columnTypes map[string]string) error {
+	in, err := OpenCSV(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	table, err := NewCsvTable(in, columnTypes)
+	if err != nil {
+		return err
+	}
+	for _, c := range table.Columns {
+		log.Debug(fmt.Sprintf("column %s: %s", c.Name, c.Type))
+	}
+
+	partName := dest + PartialFileSuffix
+	out, err := os.OpenFile(partName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partName)
+	defer out.Close()
+
+	pw, err := writer.NewCSVWriterFromWriter(parquetSchema(table.Columns), out, 4)
+	if err != nil {
+		return err
+	}
+	rows := 0
+	for {
+		row, err := table.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		err = pw.Write(row)
+		if err != nil {
+			return err
+		}
+		rows += 1
+	}
+	err = pw.WriteStop()
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	log.Debug(fmt.Sprintf("wrote %d rows to %s", rows, dest))
+	return os.Rename(partName, dest)
+}
+
+// ConvertFiles converts the downloaded copies of the given files, skipping files that haven't been downloaded or that
+// have already been converted
+func ConvertFiles(files []ExtractFile, format string, useFileHierarchy bool, overwriteExisting bool) error {
+	converted, skipped, errorCount := 0, 0, 0
+	for _, f := range files {
+		fileName, err := f.LocalPath(useFileHierarchy)
+		if err != nil {
+			log.WithError(err).Error(fmt.Sprintf("error converting %s", f.Name))
+			errorCount += 1
+			continue
+		}
+		if !fileExists(fileName) {
+			log.Debug(fmt.Sprintf("%s not found at %s, skipping", f.Name, fileName))
+			continue
+		}
+		dest := ConvertedPath(fileName, format)
+		if fileExists(dest) && !overwriteExisting {
+			log.Info(fmt.Sprintf("%s exists, skipping. re-run with --overwrite-existing to convert anyway", dest))
+			skipped += 1
+			continue
+		}
+		log.Info(fmt.Sprintf("Converting %s to %s", f.Name, dest))
+		err = ConvertToParquet(fileName, dest, config.ColumnTypes[f.Dataset])
+		if err != nil {
+			log.WithError(err).Error(fmt.Sprintf("error converting %s", f.Name))
+			errorCount += 1
+			continue
+		}
+		converted += 1
+	}
+	if converted+skipped+errorCount == 0 {
+		return ErrNoDownloadedFiles
+	}
+	log.Info(fmt.Sprintf("Converted %d file(s), skipped %d existing file(s), encountered %d error(s)", converted, skipped, errorCount))
+	if errorCount > 0 {
+		return fmt.Errorf("conversion completed with %d error(s)", errorCount)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	t.Run("should infer column types", func(t *testing.T) {
+		table, err := NewCsvTable(strings.NewReader("id,speed,wifi,name,empty\n1,10.5,true,a,\n2,,false,b,\n"), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, []Column{
+			{Name: "id", Type: ColumnInt64},
+			{Name: "speed", Type: ColumnDouble},
+			{Name: "wifi", Type: ColumnBoolean},
+			{Name: "name", Type: ColumnString},
+			{Name: "empty", Type: ColumnString},
+		}, table.Columns)
+		row, err := table.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{int64(1), 10.5, true, "a", nil}, row)
+		row, err = table.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{int64(2), nil, false, "b", nil}, row)
+	})
+
+	t.Run("should prefer configured column types", func(t *testing.T) {
+		table, err := NewCsvTable(strings.NewReader("id,code\n1,01\n"), map[string]string{"code": ColumnString})
+		assert.Nil(t, err)
+		assert.Equal(t, ColumnString, table.Columns[1].Type)
+		row, _ := table.Next()
+		assert.Equal(t, "01", row[1])
+
+		_, err = NewCsvTable(strings.NewReader("id\n1\n"), map[string]string{"id": "uint128"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("should report values that don't match the column type", func(t *testing.T) {
+		table, err := NewCsvTable(strings.NewReader("id\nabc\n"), map[string]string{"id": ColumnInt64})
+		assert.Nil(t, err)
+		_, err = table.Next()
+		assert.ErrorContains(t, err, "column_types")
+	})
+
+	t.Run("should keep the extract naming", func(t *testing.T) {
+		assert.Equal(t, filepath.Join("data", "stnet_2022-05-01.parquet"), ConvertedPath(filepath.Join("data", "stnet_2022-05-01.zip"), ConvertParquet))
+		assert.Equal(t, "fixed_export_2022-05-01.parquet", ConvertedPath("fixed_export_2022-05-01.csv.gz", ConvertParquet))
+	})
+
+	t.Run("should convert zipped csv to parquet", func(t *testing.T) {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "stnet_2022-05-01.zip")
+		writeZip(t, archive, map[string]string{"stnet_2022-05-01.csv": "test id,download_kbps,is_wifi,country\n1,1500.5,true,US\n2,,false,CA\n3,900,true,\n"})
+		dest := ConvertedPath(archive, ConvertParquet)
+		assert.Nil(t, ConvertToParquet(archive, dest, nil))
+		assert.NoFileExists(t, dest+PartialFileSuffix)
+
+		f, err := local.NewLocalFileReader(dest)
+		assert.Nil(t, err)
+		defer f.Close()
+		pr, err := reader.NewParquetColumnReader(f, 1)
+		assert.Nil(t, err)
+		defer pr.ReadStop()
+		assert.Equal(t, int64(3), pr.GetNumRows())
+
+		ids, _, _, err := pr.ReadColumnByIndex(0, 3)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{int64(1), int64(2), int64(3)}, ids)
+		speeds, _, _, err := pr.ReadColumnByIndex(1, 3)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{1500.5, nil, 900.0}, speeds)
+		countries, _, _, err := pr.ReadColumnByIndex(3, 3)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{"US", "CA", nil}, countries)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Environment variables that override the credentials in the config file, the same names as the env layer gives them
+const (
+	ApiKeyEnv    = "SPEEDTEST_API_KEY"
+	ApiSecretEnv = "SPEEDTEST_API_SECRET"
+)
+
+// secretCommandTimeout stops a hung api_secret_command, e.g. one waiting on a prompt that will never be answered
+const secretCommandTimeout = 30 * time.Second
+
+// ResolveCredentials sets the api secret from the highest precedence source, so secrets can be kept out of the config
+// file. The secret comes from, in order:
+//  1. the output of api_secret_command
+//  2. the contents of api_secret_file
+//  3. api_secret
+//
+// A layer that sets any of these, e.g. SPEEDTEST_API_SECRET, replaces all of them from the layers below it. A relative
+// api_secret_file is found next to the config file, like the state file.
+func ResolveCredentials(c *Config, configFile string) error {
+	if len(c.ApiSecretCommand) > 0 {
+		log.Debug("using api secret from api_secret_command")
+		secret, err := runSecretCommand(c.ApiSecretCommand)
+		if err != nil {
+			return err
+		}
+		c.ApiSecret = secret
+		c.setSource("api_secret", c.Source("api_secret_command"))
+	} else if len(c.ApiSecretFile) > 0 {
+		fileName := expandHome(c.ApiSecretFile)
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(filepath.Dir(configFile), fileName)
+		}
+		log.Debug(fmt.Sprintf("using api secret from %s", fileName))
+		contents, err := os.ReadFile(fileName)
+		if err != nil {
+			return fmt.Errorf("unable to read api_secret_file: %w", err)
+		}
+		c.ApiSecret = strings.TrimSpace(string(contents))
+		c.setSource("api_secret", c.Source("api_secret_file"))
+	}
+
+	if len(c.ApiKey) == 0 || len(c.ApiSecret) == 0 {
+		return ErrMissingAuth
+	}
+	if c.ApiKey == DefaultConfig.ApiKey || c.ApiSecret == DefaultConfig.ApiSecret {
+		return ErrDefaultConfig
+	}
+	return nil
+}
+
+// runSecretCommand runs the command with the system shell and returns what it prints, without surrounding whitespace
+func runSecretCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("api_secret_command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	secret := strings.TrimSpace(string(out))
+	if len(secret) == 0 {
+		return "", fmt.Errorf("api_secret_command printed an empty secret")
+	}
+	return secret, nil
+}
@@ -1,24 +1,47 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
+// PartialFileSuffix is appended to the name of a file while it is being downloaded
+const PartialFileSuffix = ".part"
+
+// Ways of ranking the files of a dataset to pick the latest ones
+const (
+	LatestByModified = "modified"
+	LatestByDataDate = "data-date"
+)
+
+var LatestByModes = []string{LatestByModified, LatestByDataDate}
+
 type ExtractItem struct {
+	//DataDate is the date of the data in the file, parsed from the _YYYY-MM-DD suffix of its name. Zero when the name
+	//doesn't include one
+	DataDate time.Time                 `json:"-"`
 	Name     string                    `json:"name"`
 	Url      string                    `json:"url"`
 	Type     string                    `json:"type"`
 	Modified int64                     `json:"mtime"`
 	Size     int64                     `json:"size"`
+	Sha256   string                    `json:"sha256,omitempty"`
+	Md5      string                    `json:"md5,omitempty"`
+	Sidecars map[string]*ExtractItem   `json:"-"`
 	Datasets map[string][]*ExtractItem `json:"-"`
 	Latest   map[string]*ExtractItem   `json:"-"`
 	Children []*ExtractItem            `json:"-"`
@@ -26,11 +49,14 @@ type ExtractItem struct {
 }
 
 type ExtractFile struct {
-	Dataset string
-	Name    string
-	Latest  bool
-	Updated time.Time
-	Item    *ExtractItem
+	//Profile is the name of the account the file belongs to when listing every profile
+	Profile  string
+	Dataset  string
+	Name     string
+	Latest   bool
+	Updated  time.Time
+	DataDate time.Time
+	Item     *ExtractItem
 }
 
 type ExtractsCache struct {
@@ -38,9 +64,34 @@ type ExtractsCache struct {
 	Responses map[string][]*ExtractItem `json:"responses"`
 }
 
+type DownloadOptions struct {
+	UseFileHierarchy  bool
+	OverwriteExisting bool
+	State             *DownloadState
+	//Mirror re-downloads unchanged files whose local copy is missing instead of trusting the state
+	Mirror   bool
+	Progress *ProgressReporter
+	Limiter  *BandwidthLimiter
+	//Extract unpacks zip and gzip files once downloaded, optionally removing the archive afterwards
+	Extract       bool
+	RemoveArchive bool
+	//Convert writes the CSV data in each file to another format, e.g. parquet, once downloaded
+	Convert string
+	//Storage is where files are downloaded to, the storage directory when not set
+	Storage Storage
+}
+
+// transfer holds everything a download streams through on the way to disk
+type transfer struct {
+	hasher  hash.Hash
+	tracker *FileProgress
+	limiter *BandwidthLimiter
+}
+
 type DownloadResult struct {
-	success bool
-	err     error
+	success  bool
+	err      error
+	checksum *Checksum
 }
 
 func (e *ExtractItem) IsDirectory() bool {
@@ -48,12 +99,24 @@ func (e *ExtractItem) IsDirectory() bool {
 }
 
 func (e *ExtractItem) IsDataset() bool {
-	return e.Type == "file" && !strings.Contains(e.Name, "headers") //ignore header files
+	return e.Type == "file" && !strings.Contains(e.Name, "headers") && !e.IsChecksumFile() //ignore header and checksum files
+}
+
+// dataDatePattern matches the date suffix in extract file names, e.g. stnet_2022-05-01.zip
+var dataDatePattern = regexp.MustCompile(`_(20\d{2}-\d{2}-\d{2})`)
+
+// ParseDataDate parses the date of the data from a file name, returning false if it doesn't include one
+func ParseDataDate(name string) (time.Time, bool) {
+	match := dataDatePattern.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+	date, err := time.Parse("2006-01-02", match[1])
+	return date, err == nil
 }
 
 func (e *ExtractItem) DatasetName() string {
-	pattern := regexp.MustCompile(`_20\d{2}-\d{2}-\d{2}`)
-	idx := pattern.FindIndex([]byte(e.Name))
+	idx := dataDatePattern.FindStringIndex(e.Name)
 
 	if len(idx) > 0 {
 		return e.Name[0:idx[0]]
@@ -64,52 +127,231 @@ func (e *ExtractItem) DatasetName() string {
 	}
 }
 
-func (e *ExtractFile) Download(client *resty.Client, useFileHierarchy bool, overwriteExisting bool) DownloadResult {
+// extract unpacks the downloaded archive alongside it
+func (e *ExtractFile) extract(fileName string, dir string, removeArchive bool) error {
+	log.Info(fmt.Sprintf("Extracting %s", e.Name))
+	written, err := ExtractArchive(fileName, dir)
+	if err != nil {
+		return fmt.Errorf("unable to extract %s: %w", e.Name, err)
+	}
+	for _, w := range written {
+		log.Debug(fmt.Sprintf("extracted %s", w))
+	}
+	if removeArchive {
+		log.Debug(fmt.Sprintf("removing %s", fileName))
+		return os.Remove(fileName)
+	}
+	return nil
+}
+
+// StoragePath returns the slash separated name the file is stored under, relative to the root of the storage. A
+// configured path template takes precedence over the file hierarchy, and fails rather than falling back to it when
+// it can't be executed for the file.
+func (e *ExtractFile) StoragePath(useFileHierarchy bool) (string, error) {
+	if pathTemplate != nil {
+		return ExecutePathTemplate(pathTemplate, *e)
+	}
+	if useFileHierarchy {
+		return path.Join(append(append([]string{}, e.Item.Groups...), e.Dataset, e.Name)...), nil
+	}
+	return e.Name, nil
+}
+
+// LocalPath returns the location the file is downloaded to
+func (e *ExtractFile) LocalPath(useFileHierarchy bool) (string, error) {
+	name, err := e.StoragePath(useFileHierarchy)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config.StorageDirectory, filepath.FromSlash(name)), nil
+}
+
+func (e *ExtractFile) Download(client *resty.Client, options DownloadOptions) DownloadResult {
 	item := e.Item
 	if item.IsDataset() {
-		paths := []string{config.StorageDirectory}
-		if useFileHierarchy {
-			paths = append(paths, e.Item.Groups...)
-			paths = append(paths, e.Dataset)
-		}
-		var path string
-		//did not use MkDirAll due to issues w/ umask filtering and dealing with diff platforms (windows)
-		for _, p := range paths {
-			path = filepath.Join(path, p)
-			err := os.Mkdir(path, 0700)
-			if err != nil && !errors.Is(err, os.ErrExist) {
-				return DownloadResult{false, err}
-			}
+		storage := options.Storage
+		if storage == nil {
+			storage = &LocalStorage{Root: config.StorageDirectory}
+		}
+		name, err := e.StoragePath(options.UseFileHierarchy)
+		if err != nil {
+			options.Progress.Skip(*e)
+			return DownloadResult{false, err, nil}
 		}
+		location := storage.Location(name)
 
-		fileName := filepath.Join(path, e.Name)
-		_, err := os.Stat(fileName)
-		if overwriteExisting || (err != nil && errors.Is(err, os.ErrNotExist)) {
-			log.Info(fmt.Sprintf("Downloading %s to %s", e.Name, path))
-			log.Debug(fmt.Sprintf("Downloading from %s", item.Url))
-			_, err = client.R().
-				SetOutput(fileName).
-				Get(item.Url)
+		overwriteExisting := options.OverwriteExisting
+		entry := options.State.Get(*e)
+		if entry != nil && !overwriteExisting {
+			exists, err := storage.Exists(name)
 			if err != nil {
-				return DownloadResult{false, err}
+				options.Progress.Skip(*e)
+				return DownloadResult{false, err, nil}
 			}
-			log.Info(fmt.Sprintf("%s complete", e.Name))
-			stats, err := os.Stat(fileName)
-			if err != nil {
-				return DownloadResult{false, err}
+			if !entry.Matches(item) {
+				log.Info(fmt.Sprintf("%s changed on the server since it was downloaded, updating", e.Name))
+			} else if options.Mirror && !exists {
+				log.Info(fmt.Sprintf("%s is missing locally, downloading", e.Name))
+			} else {
+				log.Info(fmt.Sprintf("%s unchanged since it was downloaded to %s, skipping. re-run with --overwrite-existing to download anyway", e.Name, entry.LocalPath))
+				options.Progress.Skip(*e)
+				return DownloadResult{false, nil, nil}
+			}
+			overwriteExisting = true
+		}
+
+		stats, err := storage.Stat(name)
+		if err == nil && !overwriteExisting {
+			log.Info(fmt.Sprintf("%s exists, skipping. re-run with --overwrite-existing to download anyway", e.Name))
+			if stats.Size == item.Size {
+				//start tracking files downloaded before the state file existed, or whose conversion or extraction
+				//failed, once they have been processed
+				err = e.postProcess(storage, name, options)
+				if err == nil {
+					err = options.State.Record(*e, location, nil)
+				}
 			}
-			downloadSize := stats.Size()
-			if item.Size != downloadSize {
-				// remove the invalid file
-				_ = os.Remove(fileName)
-				return DownloadResult{false, fmt.Errorf("filesize mismatch for %s. expected: %d, received: %d", e.Name, item.Size, downloadSize)}
+			options.Progress.Skip(*e)
+			return DownloadResult{false, err, nil}
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			options.Progress.Skip(*e)
+			return DownloadResult{false, err, nil}
+		}
+
+		//data left over from an interrupted download is resumed rather than started over
+		var offset int64
+		resumable, canResume := storage.(ResumableStorage)
+		if canResume && !overwriteExisting {
+			offset = partialSize(resumable, name)
+			if offset > item.Size {
+				offset = 0
 			}
+		}
+
+		if offset > 0 && offset == item.Size {
+			log.Info(fmt.Sprintf("%s was already fully downloaded to %s, verifying", e.Name, location))
+		} else if offset > 0 {
+			log.Info(fmt.Sprintf("Resuming %s to %s at byte %d", e.Name, location, offset))
 		} else {
-			log.Info(fmt.Sprintf("%s exists, skipping. re-run with --overwrite-existing to download anyway", e.Name))
-			return DownloadResult{false, nil}
+			log.Info(fmt.Sprintf("Downloading %s to %s", e.Name, location))
+		}
+		log.Debug(fmt.Sprintf("Downloading from %s", item.Url))
+		tracker := options.Progress.Start(*e, offset)
+		finish := func(result DownloadResult) DownloadResult {
+			tracker.Done(result.err)
+			return result
+		}
+		expected, err := item.ExpectedChecksum(client)
+		if err != nil {
+			return finish(DownloadResult{false, err, nil})
+		}
+		algorithm := ChecksumMd5 //matches the ETag used when the index doesn't provide a checksum
+		if expected != nil {
+			algorithm = expected.Algorithm
+		}
+		hasher := NewHash(algorithm)
+		var download *downloaded
+		if offset > 0 && offset == item.Size {
+			//nothing is left to request, the kept bytes only need to be verified and committed
+			download, err = completePartial(resumable, name, offset, hasher)
+			if err == nil && expected == nil {
+				download.etag, err = item.RemoteChecksum(client)
+			}
+		} else {
+			retry := config.DownloadRetry.WithDefaults(DefaultDownloadRetry)
+			for attempt := 1; ; attempt++ {
+				download, err = downloadFile(client, item.Url, storage, name, offset, transfer{hasher, tracker, options.Limiter})
+				//failed requests are retried by the client, only a connection dropped mid-transfer is retried here
+				if err == nil || !errors.Is(err, ErrInterrupted) || attempt >= retry.MaxAttempts {
+					break
+				}
+				delay := retry.Backoff(attempt)
+				log.WithError(err).WithField("attempt", attempt).Debug(fmt.Sprintf("resuming %s in %s", e.Name, delay))
+				time.Sleep(delay)
+				offset = 0
+				if canResume {
+					offset = partialSize(resumable, name)
+				}
+			}
+		}
+		if err != nil {
+			return finish(DownloadResult{false, err, nil})
+		}
+		log.Info(fmt.Sprintf("%s complete", e.Name))
+		if item.Size != download.size {
+			// remove the invalid file
+			_ = download.writer.Abort()
+			return finish(DownloadResult{false, fmt.Errorf("filesize mismatch for %s. expected: %d, received: %d", e.Name, item.Size, download.size), nil})
+		}
+		if expected == nil {
+			expected = download.etag
 		}
+		digest := hex.EncodeToString(hasher.Sum(nil))
+		if expected == nil {
+			log.Debug(fmt.Sprintf("no checksum available for %s, skipping verification", e.Name))
+		} else if !expected.Matches(digest) {
+			_ = download.writer.Abort()
+			return finish(DownloadResult{false, fmt.Errorf("%w for %s. expected %s from %s, received: %s", ErrChecksumMismatch, e.Name, expected, expected.Source, digest), nil})
+		} else {
+			log.Debug(fmt.Sprintf("verified %s %s from %s", e.Name, expected, expected.Source))
+		}
+		err = download.writer.Commit()
+		if err != nil {
+			return finish(DownloadResult{false, err, nil})
+		}
+		//check what actually arrived in storage, remote storage may have dropped or truncated the upload
+		stored, err := storage.Stat(name)
+		if err != nil {
+			return finish(DownloadResult{false, fmt.Errorf("unable to verify %s: %w", location, err), nil})
+		} else if stored.Size != item.Size {
+			_ = storage.Delete(name)
+			return finish(DownloadResult{false, fmt.Errorf("filesize mismatch for %s. expected: %d, stored: %d", location, item.Size, stored.Size), nil})
+		}
+		checksum := &Checksum{Algorithm: algorithm, Value: digest, Source: "download"}
+		err = e.postProcess(storage, name, options)
+		if err != nil {
+			return finish(DownloadResult{false, err, checksum})
+		}
+		//the download is only recorded once it has been converted and extracted, so a failure is retried next time
+		err = options.State.Record(*e, location, checksum)
+		if err != nil {
+			return finish(DownloadResult{false, fmt.Errorf("unable to record download of %s: %w", e.Name, err), nil})
+		}
+		return finish(DownloadResult{true, nil, checksum})
+	}
+	return DownloadResult{true, nil, nil}
+}
+
+// postProcess converts and extracts the downloaded file as requested. Both work on the downloaded file, which is only
+// available with local storage.
+func (e *ExtractFile) postProcess(storage Storage, name string, options DownloadOptions) error {
+	local, ok := storage.(*LocalStorage)
+	if !ok {
+		return nil
+	}
+	fileName := local.Path(name)
+	if len(options.Convert) > 0 {
+		dest := ConvertedPath(fileName, options.Convert)
+		log.Info(fmt.Sprintf("Converting %s to %s", e.Name, dest))
+		err := ConvertToParquet(fileName, dest, config.ColumnTypes[e.Dataset])
+		if err != nil {
+			return fmt.Errorf("unable to convert %s: %w", e.Name, err)
+		}
+	}
+	if options.Extract && IsArchive(fileName) {
+		return e.extract(fileName, filepath.Dir(fileName), options.RemoveArchive)
 	}
-	return DownloadResult{true, nil}
+	return nil
+}
+
+// partialSize returns the number of bytes kept from an interrupted download of name
+func partialSize(storage ResumableStorage, name string) int64 {
+	partial, size, err := storage.Partial(name)
+	if err != nil {
+		return 0
+	}
+	_ = partial.Close()
+	return size
 }
 
 func WriteExtractsCache(cache *ExtractsCache) {
@@ -183,16 +425,7 @@ func GetExtracts(client *resty.Client, path string, cache *ExtractsCache) ([]*Ex
 			return nil, err
 		}
 		if len(path) == 0 && resp.IsError() {
-			switch resp.StatusCode() {
-			case 401, 403:
-				err = ErrAuth
-			case 404:
-				err = ErrNoExtract
-			case 500:
-				err = ErrServerError
-			default:
-				err = ErrUnknownStatus
-			}
+			err = IndexStatusError(resp.StatusCode())
 			log.WithError(err).Debug(fmt.Sprintf("error retrieving extract data from %s", url))
 			return nil, err
 		}
@@ -216,6 +449,7 @@ func GetExtracts(client *resty.Client, path string, cache *ExtractsCache) ([]*Ex
 				return nil, err
 			}
 			extracts[i].Children = make([]*ExtractItem, 0)
+			linkChecksumFiles(children)
 			for _, child := range children {
 				if child.IsDirectory() || child.IsDataset() {
 					extracts[i].Children = append(extracts[i].Children, child)
@@ -229,27 +463,91 @@ func GetExtracts(client *resty.Client, path string, cache *ExtractsCache) ([]*Ex
 				}
 
 				if child.IsDataset() {
+					child.DataDate, _ = ParseDataDate(child.Name)
 					name := child.DatasetName()
 					if extracts[i].Latest == nil {
 						extracts[i].Latest = make(map[string]*ExtractItem, 0)
 						extracts[i].Datasets = make(map[string][]*ExtractItem, 0)
 					}
 					extracts[i].Datasets[name] = append(extracts[i].Datasets[name], child)
-
-					if latest, ok := extracts[i].Latest[name]; !ok || extracts[i].Modified > latest.Modified {
-						extracts[i].Latest[name] = child
-					}
 				}
 			}
+			for name, datasets := range extracts[i].Datasets {
+				extracts[i].Latest[name] = RankDataset(datasets, LatestByModified)[0]
+			}
 		}
 	}
 	return extracts, nil
 }
 
-func FilterFiles(items []*ExtractItem, groupFilter []string, datasetFilter []string, filenameFilter []string, since *time.Time, latestOnly bool, files []ExtractFile) []ExtractFile {
-	if since != nil {
-		latestOnly = false
+// IndexStatusError explains an error status from the extracts index
+func IndexStatusError(status int) error {
+	switch status {
+	case 401, 403:
+		return ErrAuth
+	case 404:
+		return ErrNoExtract
+	case 429:
+		return ErrRateLimited
+	default:
+		if status >= 500 {
+			return ErrServerError
+		}
+		return ErrUnknownStatus
+	}
+}
+
+// CheckCredentials requests the top of the extracts index to check that it can be reached with the configured
+// credentials
+func CheckCredentials() error {
+	resp, err := GetClient(false).R().Get(config.ExtractUrl)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return IndexStatusError(resp.StatusCode())
+	}
+	return nil
+}
+
+// linkChecksumFiles attaches sidecar checksum files (e.g. stnet_2022-05-01.zip.sha256) to the file they describe
+func linkChecksumFiles(items []*ExtractItem) {
+	byName := make(map[string]*ExtractItem, len(items))
+	for _, item := range items {
+		byName[item.Name] = item
+	}
+	for _, item := range items {
+		if target, algorithm := item.checksumTarget(); len(algorithm) > 0 {
+			if file, ok := byName[target]; ok && file.IsDataset() {
+				if file.Sidecars == nil {
+					file.Sidecars = make(map[string]*ExtractItem)
+				}
+				file.Sidecars[algorithm] = item
+			}
+		}
 	}
+}
+
+// RankDataset returns the files of a dataset from newest to oldest. By default files are ranked by the time they
+// were modified on the server, or with LatestByDataDate by the date of the data in their name, in which case files
+// without one rank last. Ties are broken by modified time and then name so the order is stable across runs.
+func RankDataset(files []*ExtractItem, by string) []*ExtractItem {
+	ranked := make([]*ExtractItem, len(files))
+	copy(ranked, files)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if by == LatestByDataDate && !a.DataDate.Equal(b.DataDate) {
+			return a.DataDate.After(b.DataDate)
+		}
+		if a.Modified != b.Modified {
+			return a.Modified > b.Modified
+		}
+		return a.Name > b.Name
+	})
+	return ranked
+}
+
+func FilterFiles(items []*ExtractItem, filter FileFilter, files []ExtractFile) []ExtractFile {
 	if files == nil {
 		files = make([]ExtractFile, 0)
 	}
@@ -257,49 +555,172 @@ func FilterFiles(items []*ExtractItem, groupFilter []string, datasetFilter []str
 		if i.IsDirectory() {
 			groups := i.Groups
 
-			matchedGroup := false
-			if len(groupFilter) == 0 {
-				matchedGroup = true
-			}
-			//TODO this group filter matches any of the terms, is there a need for an "all" filter?
-			for _, g := range groups {
-				if contains(g, groupFilter) {
-					matchedGroup = true
-				}
-			}
-
-			if matchedGroup {
+			if filter.matchesGroups(groups) {
 				for name, datasets := range i.Datasets {
 					dataset := name
-					if len(datasetFilter) == 0 || contains(dataset, datasetFilter) {
+					if filter.Datasets.MatchOrEmpty(dataset) && !filter.ExcludeDatasets.Match(dataset) {
+						ranked := RankDataset(datasets, filter.LatestBy)
+						latest := ranked[0]
+						recent := make(map[*ExtractItem]bool, filter.Latest)
+						for _, d := range ranked {
+							if len(recent) >= filter.Latest {
+								break
+							}
+							if !filter.LatestMatching || filter.matchesItem(d) {
+								recent[d] = true
+							}
+						}
 						for _, d := range datasets {
 							filename := d.Name
-							if len(filenameFilter) == 0 || contains(filename, filenameFilter) {
-								if !latestOnly || d == i.Latest[name] {
+							if filter.Filenames.MatchOrEmpty(filename) && !filter.ExcludeFilenames.Match(filename) {
+								if (filter.Latest == 0 || recent[d]) && filter.matchesItem(d) {
 									updated := time.UnixMilli(d.Modified).UTC()
-									if since == nil || updated.Equal(*since) || updated.After(*since) {
-										log.WithFields(log.Fields{
-											"groups":  groups,
-											"dataset": dataset,
-											"latest":  d == i.Latest[name],
-											"updated": updated,
-										}).Debug(fmt.Sprintf("found file matching all filters: %s", filename))
-										files = append(files, ExtractFile{
-											Dataset: dataset,
-											Name:    filename,
-											Latest:  d == i.Latest[name],
-											Updated: updated,
-											Item:    d,
-										})
-									}
+									log.WithFields(log.Fields{
+										"groups":   groups,
+										"dataset":  dataset,
+										"latest":   d == latest,
+										"updated":  updated,
+										"dataDate": d.DataDate,
+									}).Debug(fmt.Sprintf("found file matching all filters: %s", filename))
+									files = append(files, ExtractFile{
+										Dataset:  dataset,
+										Name:     filename,
+										Latest:   d == latest,
+										Updated:  updated,
+										DataDate: d.DataDate,
+										Item:     d,
+									})
 								}
 							}
 						}
 					}
 				}
 			}
-			files = FilterFiles(i.Children, groupFilter, datasetFilter, filenameFilter, since, latestOnly, files)
+			files = FilterFiles(i.Children, filter, files)
 		}
 	}
 	return files
 }
+
+// downloaded is a completed transfer waiting to be verified before it is committed to storage
+type downloaded struct {
+	writer StorageWriter
+	size   int64
+	etag   *Checksum
+}
+
+// downloadFile streams url into name in storage, hashing the contents as they are written. When offset is positive
+// the bytes kept from an interrupted write are resumed and only the remainder is requested with a Range header, falling
+// back to a full download if the server does not honor it. Progress is reported to the tracker and the rate is capped
+// by the limiter, either of which may be nil. Returns the uncommitted write along with the checksum in the ETag
+// reported by the server, if any.
+func downloadFile(client *resty.Client, url string, storage Storage, name string, offset int64, t transfer) (*downloaded, error) {
+	req := client.R().SetDoNotParseResponse(true)
+	if offset > 0 {
+		req.SetHeader("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := req.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.RawBody()
+	defer body.Close()
+
+	resume := false
+	switch {
+	case offset > 0 && resp.StatusCode() == http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header().Get("Content-Range"))
+		if err != nil || start != offset {
+			log.Debug(fmt.Sprintf("unexpected Content-Range %q for %s, restarting download", resp.Header().Get("Content-Range"), name))
+			return downloadFile(client, url, storage, name, 0, t)
+		}
+		resume = true
+	case offset > 0 && resp.StatusCode() == http.StatusRequestedRangeNotSatisfiable:
+		log.Debug(fmt.Sprintf("range not satisfiable for %s, restarting download", name))
+		return downloadFile(client, url, storage, name, 0, t)
+	case resp.IsError():
+		return nil, fmt.Errorf("unexpected status downloading %s: %s", url, resp.Status())
+	case offset > 0:
+		log.Debug(fmt.Sprintf("server ignored range request for %s (Accept-Ranges: %q), restarting download", name, resp.Header().Get("Accept-Ranges")))
+	}
+
+	t.hasher.Reset()
+	if !resume {
+		offset = 0
+	}
+	t.tracker.Reset(offset)
+	var out StorageWriter
+	if resume {
+		//only resumable storage is asked for a range
+		out, err = resumePartial(storage.(ResumableStorage), name, offset, t.hasher)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		out, err = storage.Writer(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	source := &sourceReader{reader: body}
+	written, err := io.Copy(io.MultiWriter(out, t.hasher, t.tracker), t.limiter.Reader(source))
+	if err != nil {
+		_ = out.Close()
+		//only a failed read is a dropped connection worth resuming, failing to write to storage is not
+		if source.err != nil && errors.Is(err, source.err) {
+			return nil, fmt.Errorf("%w: %w", ErrInterrupted, err)
+		}
+		return nil, err
+	}
+	return &downloaded{writer: out, size: offset + written, etag: ETagChecksum(resp.Header())}, nil
+}
+
+// resumePartial continues the interrupted write to name, bringing the hash up to date with the offset bytes kept so far
+func resumePartial(storage ResumableStorage, name string, offset int64, hasher hash.Hash) (StorageWriter, error) {
+	existing, _, err := storage.Partial(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(hasher, existing, offset)
+	_ = existing.Close()
+	if err != nil {
+		return nil, err
+	}
+	return storage.Resume(name)
+}
+
+// completePartial returns the interrupted write to name as a completed transfer when it already holds all size bytes,
+// so it is verified and committed without being requested again.
+func completePartial(storage ResumableStorage, name string, size int64, hasher hash.Hash) (*downloaded, error) {
+	hasher.Reset()
+	out, err := resumePartial(storage, name, size, hasher)
+	if err != nil {
+		return nil, err
+	}
+	return &downloaded{writer: out, size: size}, nil
+}
+
+// sourceReader keeps the error reading the response body, telling a dropped connection apart from other failures
+type sourceReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// contentRangeStart returns the first byte position of a "bytes start-end/size" Content-Range header.
+func contentRangeStart(contentRange string) (int64, error) {
+	var start, end int64
+	var size string
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &size)
+	if err != nil {
+		return 0, err
+	}
+	return start, nil
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
 	"net/http"
@@ -19,6 +24,13 @@ type FilterCounts struct {
 	Latest   int
 }
 
+// localPath returns the location the file is downloaded to, failing the test when it can't be worked out
+func localPath(t *testing.T, f ExtractFile, useFileHierarchy bool) string {
+	name, err := f.LocalPath(useFileHierarchy)
+	assert.Nil(t, err)
+	return name
+}
+
 func ReadResponseFixture(name string) ([]byte, error) {
 	file := name + ".json"
 	content, err := os.ReadFile(filepath.Join("fixtures", file))
@@ -55,7 +67,11 @@ func GetTestExtracts() ([]*ExtractItem, error) {
 }
 
 func RunFilters(t *testing.T, extracts []*ExtractItem, groupFilter []string, datasetFilter []string, filenameFilter []string, since *time.Time, latestOnly bool, expected FilterCounts) []ExtractFile {
-	files := FilterFiles(extracts, groupFilter, datasetFilter, filenameFilter, since, latestOnly, nil)
+	filter := FileFilter{Groups: groupFilter, Datasets: datasetFilter, Filenames: filenameFilter, Since: since}
+	if latestOnly {
+		filter.Latest = 1
+	}
+	files := FilterFiles(extracts, filter, nil)
 
 	latestCount := 0
 	groups := make(map[string]interface{})
@@ -162,8 +178,32 @@ func TestFilters(t *testing.T) {
 		}
 	})
 
+	t.Run("should parse the data date from file names", func(t *testing.T) {
+		files := FilterFiles(extracts, FileFilter{}, nil)
+		for _, f := range files {
+			assert.Equal(t, strings.TrimSuffix(f.Name[len(f.Dataset)+1:], ".zip"), f.DataDate.Format("2006-01-02"))
+		}
+		_, ok := ParseDataDate("stnet_export.zip")
+		assert.False(t, ok)
+	})
+
+	t.Run("should filter for files with data in a given period", func(t *testing.T) {
+		from, _ := time.Parse("2006-01-02", "2022-04-01")
+		to, _ := time.Parse("2006-01-02", "2022-04-30")
+		files := FilterFiles(extracts, FileFilter{PeriodFrom: &from, PeriodTo: &to}, nil)
+		assert.Len(t, files, 8)
+		for _, f := range files {
+			assert.Equal(t, from, f.DataDate, "all files with data outside of April should be filtered")
+		}
+
+		files = FilterFiles(extracts, FileFilter{PeriodFrom: &from}, nil)
+		assert.Len(t, files, 16)
+		files = FilterFiles(extracts, FileFilter{PeriodTo: &from}, nil)
+		assert.Len(t, files, 16)
+	})
+
 	t.Run("should filter for latest version of specific filenames", func(t *testing.T) {
-		filenames := []string{"android_2022-05-01.zip", "desktop_2022-04-01.zip"}
+		filenames := []string{"android_2022-05-01.zip", "desktop_2022-05-01.zip"}
 		files := RunFilters(t, extracts, []string{}, []string{}, filenames, nil, true, FilterCounts{
 			Files:    2,
 			Groups:   2,
@@ -175,3 +215,475 @@ func TestFilters(t *testing.T) {
 		}
 	})
 }
+
+func TestLatest(t *testing.T) {
+	//the restated fixture has an older extract that was regenerated after the newer ones
+	client := resty.New()
+	client.SetHeader("Content-Type", "application/json")
+	config.ExtractUrl = MockServer.URL + "/extracts"
+	extracts, err := GetExtracts(client, "/latest/", nil)
+	assert.Nil(t, err)
+
+	names := func(files []ExtractFile) []string {
+		result := make([]string, 0, len(files))
+		for _, f := range files {
+			result = append(result, f.Name)
+		}
+		return result
+	}
+	latest := func(files []ExtractFile) string {
+		for _, f := range files {
+			if f.Latest {
+				return f.Name
+			}
+		}
+		return ""
+	}
+
+	t.Run("should pick the most recently modified file by default", func(t *testing.T) {
+		assert.Equal(t, "stnet_2022-03-01.zip", extracts[0].Latest["stnet"].Name)
+		files := FilterFiles(extracts, FileFilter{Latest: 1}, nil)
+		assert.Equal(t, []string{"stnet_2022-03-01.zip"}, names(files))
+		assert.True(t, files[0].Latest)
+	})
+
+	t.Run("should pick the file with the newest data date", func(t *testing.T) {
+		files := FilterFiles(extracts, FileFilter{Latest: 1, LatestBy: LatestByDataDate}, nil)
+		assert.Equal(t, []string{"stnet_2022-05-01.zip"}, names(files))
+		assert.True(t, files[0].Latest)
+
+		ranked := RankDataset(extracts[0].Datasets["stnet"], LatestByDataDate)
+		assert.Equal(t, "stnet_export.zip", ranked[len(ranked)-1].Name, "files without a data date should rank last")
+	})
+
+	t.Run("should keep the n most recent files of each dataset", func(t *testing.T) {
+		files := FilterFiles(extracts, FileFilter{Latest: 2}, nil)
+		assert.ElementsMatch(t, []string{"stnet_2022-03-01.zip", "stnet_2022-05-01.zip"}, names(files))
+		assert.Equal(t, "stnet_2022-03-01.zip", latest(files))
+
+		files = FilterFiles(extracts, FileFilter{Latest: 3, LatestBy: LatestByDataDate}, nil)
+		assert.ElementsMatch(t, []string{"stnet_2022-05-01.zip", "stnet_2022-04-01.zip", "stnet_2022-03-01.zip"}, names(files))
+		assert.Equal(t, "stnet_2022-05-01.zip", latest(files))
+	})
+
+	t.Run("should keep every file when n is larger than the dataset", func(t *testing.T) {
+		files := FilterFiles(extracts, FileFilter{Latest: 10}, nil)
+		assert.Len(t, files, 4)
+		assert.Len(t, FilterFiles(extracts, FileFilter{}, nil), 4)
+	})
+
+	t.Run("should keep the n most recent files that match the date and size filters", func(t *testing.T) {
+		until := time.Date(2022, 6, 30, 0, 0, 0, 0, time.UTC)
+		files := FilterFiles(extracts, FileFilter{Latest: 2, LatestMatching: true, Until: &until}, nil)
+		assert.ElementsMatch(t, []string{"stnet_2022-05-01.zip", "stnet_2022-04-01.zip"}, names(files))
+		assert.Equal(t, "", latest(files), "the latest file of the dataset is filtered out")
+
+		periodTo := time.Date(2022, 4, 30, 0, 0, 0, 0, time.UTC)
+		files = FilterFiles(extracts, FileFilter{Latest: 2, LatestMatching: true, PeriodTo: &periodTo, MaxSize: 610}, nil)
+		assert.Equal(t, []string{"stnet_2022-04-01.zip"}, names(files))
+	})
+
+	t.Run("should leave out the latest file when it doesn't match the size filters by default", func(t *testing.T) {
+		assert.Empty(t, FilterFiles(extracts, FileFilter{Latest: 1, MaxSize: 610}, nil))
+		files := FilterFiles(extracts, FileFilter{Latest: 1, MinSize: 611}, nil)
+		assert.Equal(t, []string{"stnet_2022-03-01.zip"}, names(files))
+		assert.True(t, files[0].Latest)
+	})
+
+	t.Run("should rank the fixture extracts by modified time", func(t *testing.T) {
+		extracts, _ := GetTestExtracts()
+		files := FilterFiles(extracts, FileFilter{Datasets: []string{"android"}, Latest: 1}, nil)
+		assert.Len(t, files, 1)
+		assert.Equal(t, int64(1654050432710), files[0].Item.Modified)
+	})
+}
+
+var errDiskFull = errors.New("no space left on device")
+
+// failingStorage fails every write, as when the disk is full
+type failingStorage struct {
+	*LocalStorage
+}
+
+func (s failingStorage) Writer(string) (StorageWriter, error) {
+	return failingWriter{}, nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errDiskFull }
+func (failingWriter) Commit() error             { return nil }
+func (failingWriter) Abort() error              { return nil }
+func (failingWriter) Close() error              { return nil }
+
+func TestDownload(t *testing.T) {
+	content := []byte(strings.Repeat("speedtest extract contents ", 64))
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		if req.URL.Path == "/no-range" {
+			_, _ = res.Write(content)
+			return
+		}
+		http.ServeContent(res, req, "stnet_2022-05-01.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	download := func(t *testing.T, path string, partial []byte) (DownloadResult, []byte) {
+		config.StorageDirectory = t.TempDir()
+		fileName := filepath.Join(config.StorageDirectory, "stnet_2022-05-01.zip")
+		if partial != nil {
+			assert.Nil(t, os.WriteFile(fileName+PartialFileSuffix, partial, 0644))
+		}
+		ranges = nil
+		file := ExtractFile{
+			Dataset: "stnet",
+			Name:    "stnet_2022-05-01.zip",
+			Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL + path, Type: "file", Size: int64(len(content))},
+		}
+		result := file.Download(resty.New(), DownloadOptions{})
+		downloaded, _ := os.ReadFile(fileName)
+		return result, downloaded
+	}
+
+	t.Run("should download a new file", func(t *testing.T) {
+		result, downloaded := download(t, "/range", nil)
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, content, downloaded)
+		assert.Equal(t, []string{""}, ranges)
+	})
+
+	t.Run("should resume a partial file with a range request", func(t *testing.T) {
+		result, downloaded := download(t, "/range", content[:100])
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, content, downloaded)
+		assert.Equal(t, []string{"bytes=100-"}, ranges)
+	})
+
+	t.Run("should verify a complete partial file without downloading it again", func(t *testing.T) {
+		result, downloaded := download(t, "/range", content)
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, content, downloaded)
+		assert.Equal(t, []string{"bytes=0-0"}, ranges, "only the etag should be requested")
+	})
+
+	t.Run("should discard a complete partial file that fails verification", func(t *testing.T) {
+		config.StorageDirectory = t.TempDir()
+		fileName := filepath.Join(config.StorageDirectory, "stnet_2022-05-01.zip")
+		assert.Nil(t, os.WriteFile(fileName+PartialFileSuffix, bytes.Repeat([]byte("x"), len(content)), 0644))
+		ranges = nil
+		sum := md5.Sum(content)
+		file := ExtractFile{
+			Dataset: "stnet",
+			Name:    "stnet_2022-05-01.zip",
+			Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL + "/range", Type: "file", Size: int64(len(content)), Md5: hex.EncodeToString(sum[:])},
+		}
+		result := file.Download(resty.New(), DownloadOptions{})
+		assert.ErrorIs(t, result.err, ErrChecksumMismatch)
+		assert.Empty(t, ranges)
+		_, err := os.Stat(fileName + PartialFileSuffix)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("should restart when the server ignores the range request", func(t *testing.T) {
+		result, downloaded := download(t, "/no-range", content[:100])
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, content, downloaded)
+	})
+
+	t.Run("should not leave a temp file behind", func(t *testing.T) {
+		result, _ := download(t, "/range", content[:100])
+		assert.Nil(t, result.err)
+		_, err := os.Stat(filepath.Join(config.StorageDirectory, "stnet_2022-05-01.zip"+PartialFileSuffix))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("should not treat a failed write as an interrupted download", func(t *testing.T) {
+		storage := failingStorage{&LocalStorage{Root: t.TempDir()}}
+		_, err := downloadFile(resty.New(), server.URL+"/range", storage, "stnet_2022-05-01.zip", 0, transfer{hasher: NewHash(ChecksumMd5)})
+		assert.ErrorIs(t, err, errDiskFull)
+		assert.NotErrorIs(t, err, ErrInterrupted)
+	})
+
+	t.Run("should skip existing files", func(t *testing.T) {
+		config.StorageDirectory = t.TempDir()
+		fileName := filepath.Join(config.StorageDirectory, "stnet_2022-05-01.zip")
+		assert.Nil(t, os.WriteFile(fileName, content, 0644))
+		ranges = nil
+		file := ExtractFile{
+			Dataset: "stnet",
+			Name:    "stnet_2022-05-01.zip",
+			Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL + "/range", Type: "file", Size: int64(len(content))},
+		}
+		result := file.Download(resty.New(), DownloadOptions{})
+		assert.Nil(t, result.err)
+		assert.False(t, result.success)
+		assert.Empty(t, ranges)
+	})
+}
+
+func TestRetry(t *testing.T) {
+	config.IndexRetry = &RetryPolicy{MaxAttempts: 3, BaseDelayMs: 1, MaxDelayMs: 5}
+	config.DownloadRetry = &RetryPolicy{MaxAttempts: 3, BaseDelayMs: 1, MaxDelayMs: 5}
+	content := []byte(strings.Repeat("speedtest extract contents ", 64))
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests += 1
+		switch {
+		case requests == 1:
+			res.Header().Set("Retry-After", "0")
+			res.WriteHeader(http.StatusTooManyRequests)
+		case requests == 2:
+			res.WriteHeader(http.StatusServiceUnavailable)
+		case req.URL.Path == "/extracts":
+			res.Header().Set("Content-Type", "application/json")
+			_, _ = res.Write([]byte("[]"))
+		default:
+			http.ServeContent(res, req, "stnet_2022-05-01.zip", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+
+	t.Run("should retry index requests", func(t *testing.T) {
+		requests = 0
+		config.ExtractUrl = server.URL + "/extracts"
+		extracts, err := GetExtracts(GetClient(false), "", nil)
+		assert.Nil(t, err)
+		assert.Len(t, extracts, 0)
+		assert.Equal(t, 3, requests)
+	})
+
+	t.Run("should give up once attempts are exhausted", func(t *testing.T) {
+		requests = 0
+		config.ExtractUrl = server.URL + "/extracts"
+		config.IndexRetry.MaxAttempts = 2
+		defer func() { config.IndexRetry.MaxAttempts = 3 }()
+		_, err := GetExtracts(GetClient(false), "", nil)
+		assert.ErrorIs(t, err, ErrServerError)
+		assert.Equal(t, 2, requests)
+	})
+
+	t.Run("should retry file downloads", func(t *testing.T) {
+		requests = 0
+		config.StorageDirectory = t.TempDir()
+		file := ExtractFile{
+			Dataset: "stnet",
+			Name:    "stnet_2022-05-01.zip",
+			Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL + "/file", Type: "file", Size: int64(len(content))},
+		}
+		result := file.Download(GetClient(true), DownloadOptions{})
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, 3, requests)
+	})
+
+	t.Run("should wait as long as retry-after asks beyond the max delay", func(t *testing.T) {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			attempts += 1
+			if attempts == 1 {
+				res.Header().Set("Retry-After", "1")
+				res.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			_, _ = res.Write([]byte("[]"))
+		}))
+		defer server.Close()
+		config.ExtractUrl = server.URL + "/extracts"
+		start := time.Now()
+		_, err := GetExtracts(GetClient(false), "", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, attempts)
+		assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+	})
+
+	t.Run("should parse retry-after headers", func(t *testing.T) {
+		now := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+		delay, ok := RetryAfter("120", now)
+		assert.True(t, ok)
+		assert.Equal(t, 2*time.Minute, delay)
+		delay, ok = RetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+		assert.True(t, ok)
+		assert.Equal(t, time.Minute, delay)
+		_, ok = RetryAfter("soon", now)
+		assert.False(t, ok)
+	})
+}
+
+func TestChecksum(t *testing.T) {
+	content := []byte(strings.Repeat("speedtest extract contents ", 64))
+	sha := sha256.Sum256(content)
+	digest := hex.EncodeToString(sha[:])
+	sum := md5.Sum(content)
+	etag := hex.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/file.sha256":
+			_, _ = res.Write([]byte(digest + "  stnet_2022-05-01.zip\n"))
+		case "/bad.sha256":
+			_, _ = res.Write([]byte(strings.Repeat("0", 64)))
+		default:
+			res.Header().Set("ETag", `"`+etag+`"`)
+			http.ServeContent(res, req, "stnet_2022-05-01.zip", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+
+	download := func(t *testing.T, items ...*ExtractItem) DownloadResult {
+		config.StorageDirectory = t.TempDir()
+		linkChecksumFiles(items)
+		file := ExtractFile{Dataset: "stnet", Name: items[0].Name, Item: items[0]}
+		return file.Download(resty.New(), DownloadOptions{})
+	}
+	newItem := func() *ExtractItem {
+		return &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL + "/file", Type: "file", Size: int64(len(content))}
+	}
+
+	t.Run("should verify against a checksum from the index", func(t *testing.T) {
+		item := newItem()
+		item.Sha256 = strings.ToUpper(digest)
+		result := download(t, item)
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, digest, result.checksum.Value)
+	})
+
+	t.Run("should reject a file that doesn't match the index checksum", func(t *testing.T) {
+		item := newItem()
+		item.Md5 = strings.Repeat("0", 32)
+		result := download(t, item)
+		assert.ErrorIs(t, result.err, ErrChecksumMismatch)
+		_, err := os.Stat(filepath.Join(config.StorageDirectory, item.Name))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("should verify against a sidecar file", func(t *testing.T) {
+		item := newItem()
+		sidecar := &ExtractItem{Name: "stnet_2022-05-01.zip.sha256", Url: server.URL + "/file.sha256", Type: "file"}
+		assert.False(t, sidecar.IsDataset())
+		result := download(t, item, sidecar)
+		assert.Nil(t, result.err)
+		assert.Equal(t, ChecksumSha256, result.checksum.Algorithm)
+
+		sidecar.Url = server.URL + "/bad.sha256"
+		result = download(t, item, sidecar)
+		assert.ErrorIs(t, result.err, ErrChecksumMismatch)
+	})
+
+	t.Run("should fall back to the etag", func(t *testing.T) {
+		item := newItem()
+		result := download(t, item)
+		assert.Nil(t, result.err)
+		assert.Equal(t, etag, result.checksum.Value)
+
+		checksum, err := item.RemoteChecksum(resty.New())
+		assert.Nil(t, err)
+		assert.Equal(t, "etag", checksum.Source)
+		header := func(values ...string) http.Header {
+			h := http.Header{}
+			for i := 0; i < len(values); i += 2 {
+				h.Set(values[i], values[i+1])
+			}
+			return h
+		}
+		assert.Nil(t, ETagChecksum(header("ETag", `"`+etag+`-2"`)), "multipart etags are not an md5 of the content")
+		assert.Nil(t, ETagChecksum(header("ETag", `"`+etag[:30]+`"`)))
+		assert.Nil(t, ETagChecksum(header("ETag", `W/"`+etag+`"`)))
+		assert.Nil(t, ETagChecksum(header("ETag", `"`+etag+`"`, "X-Amz-Server-Side-Encryption", "aws:kms")), "kms encrypted etags are not an md5 of the content")
+		assert.Nil(t, ETagChecksum(header("ETag", `"`+etag+`"`, "X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")))
+		assert.NotNil(t, ETagChecksum(header("ETag", `"`+etag+`"`, "X-Amz-Server-Side-Encryption", "AES256")))
+	})
+
+	t.Run("should report files that can't be verified and carry on", func(t *testing.T) {
+		config.StorageDirectory = t.TempDir()
+		good := ExtractFile{Dataset: "stnet", Name: "stnet_2022-05-01.zip", Item: newItem()}
+		broken := ExtractFile{Dataset: "stnet", Name: "stnet_2022-06-01.zip", Item: &ExtractItem{Name: "stnet_2022-06-01.zip", Url: server.URL + "/missing.sha256", Type: "file"}}
+		broken.Item.Sidecars = map[string]*ExtractItem{ChecksumSha256: {Name: "stnet_2022-06-01.zip.sha256", Url: "http://127.0.0.1:1/stnet_2022-06-01.zip.sha256"}}
+		for _, f := range []ExtractFile{broken, good} {
+			assert.Nil(t, os.WriteFile(localPath(t, f, false), content, 0644))
+		}
+		err := VerifyFiles([]ExtractFile{broken, good}, resty.New(), false)
+		assert.ErrorContains(t, err, "unable to verify 1 file(s)")
+	})
+}
+
+func TestDownloadState(t *testing.T) {
+	content := []byte(strings.Repeat("speedtest extract contents ", 64))
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests += 1
+		http.ServeContent(res, req, "stnet_2022-05-01.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	config.StorageDirectory = t.TempDir()
+	stateFile := filepath.Join(t.TempDir(), ".extracts-state.json")
+	state, err := LoadState(stateFile)
+	assert.Nil(t, err)
+	file := ExtractFile{
+		Dataset: "stnet",
+		Name:    "stnet_2022-05-01.zip",
+		Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL, Type: "file", Size: int64(len(content)), Modified: 1651372011932, Groups: []string{"web"}},
+	}
+	options := DownloadOptions{State: state}
+
+	t.Run("should record downloaded files", func(t *testing.T) {
+		result := file.Download(resty.New(), options)
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+
+		saved, err := LoadState(stateFile)
+		assert.Nil(t, err)
+		entry := saved.Get(file)
+		assert.NotNil(t, entry)
+		assert.Equal(t, "web/stnet_2022-05-01.zip", entry.Key)
+		assert.Equal(t, localPath(t, file, false), entry.LocalPath)
+		assert.Equal(t, result.checksum.String(), entry.Checksum)
+	})
+
+	t.Run("should skip unchanged files even if the local copy was removed", func(t *testing.T) {
+		assert.Nil(t, os.Remove(localPath(t, file, false)))
+		requests = 0
+		result := file.Download(resty.New(), options)
+		assert.Nil(t, result.err)
+		assert.False(t, result.success)
+		assert.Equal(t, 0, requests)
+		status, _ := state.Status(file, &LocalStorage{Root: config.StorageDirectory}, false)
+		assert.Equal(t, StatusCurrent, status)
+	})
+
+	t.Run("should download files that changed on the server", func(t *testing.T) {
+		file.Item.Modified += 1000
+		status, _ := state.Status(file, &LocalStorage{Root: config.StorageDirectory}, false)
+		assert.Equal(t, StatusChanged, status)
+		requests = 0
+		result := file.Download(resty.New(), options)
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, 1, requests)
+		status, _ = state.Status(file, &LocalStorage{Root: config.StorageDirectory}, false)
+		assert.Equal(t, StatusCurrent, status)
+	})
+
+	t.Run("should not record files that failed to extract", func(t *testing.T) {
+		//the served content isn't a valid zip, so extracting it fails
+		june := file
+		june.Name = "stnet_2022-06-01.zip"
+		june.Item = &ExtractItem{Name: june.Name, Url: server.URL, Type: "file", Size: int64(len(content)), Modified: 1654050411932, Groups: []string{"web"}}
+		result := june.Download(resty.New(), DownloadOptions{State: state, Extract: true})
+		assert.ErrorContains(t, result.err, "unable to extract")
+		assert.Nil(t, state.Get(june))
+		status, _ := state.Status(june, &LocalStorage{Root: config.StorageDirectory}, false)
+		assert.NotEqual(t, StatusCurrent, status)
+
+		//the next run extracts the existing file again rather than recording it as done
+		result = june.Download(resty.New(), DownloadOptions{State: state, Extract: true})
+		assert.ErrorContains(t, result.err, "unable to extract")
+		assert.Nil(t, state.Get(june))
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of matching the group filter against the groups of a file
+const (
+	GroupsMatchAny = "any"
+	GroupsMatchAll = "all"
+)
+
+var GroupsMatchModes = []string{GroupsMatchAny, GroupsMatchAll}
+
+// Orders that files can be sorted in
+const (
+	SortName    = "name"
+	SortSize    = "size"
+	SortUpdated = "updated"
+	SortDataset = "dataset"
+)
+
+var SortOrders = []string{SortName, SortSize, SortUpdated, SortDataset}
+
+// RegexPatternPrefix marks a pattern as a regular expression rather than a name or glob
+const RegexPatternPrefix = "re:"
+
+// FileFilter selects the files to work with from the extracts index. A file must match every filter that is set.
+// Within the group, dataset and filename filters a file needs to match any one of the patterns, except for groups
+// with GroupsMatchAll, and exclusions always win over inclusions.
+type FileFilter struct {
+	Groups           Patterns
+	Datasets         Patterns
+	Filenames        Patterns
+	ExcludeGroups    Patterns
+	ExcludeDatasets  Patterns
+	ExcludeFilenames Patterns
+	//GroupsMatch is GroupsMatchAll to require every group pattern to match one of the groups of a file
+	GroupsMatch string
+	//Since and Until match files modified on the server from Since and before Until
+	Since *time.Time
+	Until *time.Time
+	//PeriodFrom and PeriodTo match files by the date of the data they contain, inclusive
+	PeriodFrom *time.Time
+	PeriodTo   *time.Time
+	//MinSize and MaxSize match files by their size in bytes, inclusive. Zero is no limit
+	MinSize int64
+	MaxSize int64
+	//Latest keeps the given number of most recent files of each dataset, ranked by LatestBy. Zero keeps them all
+	Latest   int
+	LatestBy string
+	//LatestMatching picks the most recent files from the ones within the date and size filters, instead of applying
+	//those filters to the most recent files
+	LatestMatching bool
+}
+
+// Patterns are names to filter on. A pattern is matched as an exact name unless it contains any of the glob
+// characters *?[, or starts with re: for a regular expression, which matches anywhere in the name unless anchored.
+type Patterns []string
+
+// regexpCache holds the compiled regular expressions so they aren't compiled again for every file
+var regexpCache sync.Map
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(strings.TrimPrefix(pattern, RegexPatternPrefix))
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.Store(pattern, re)
+	return re, nil
+}
+
+// IsLiteralPattern is true for patterns that match a name exactly
+func IsLiteralPattern(pattern string) bool {
+	return !strings.HasPrefix(pattern, RegexPatternPrefix) && !strings.ContainsAny(pattern, "*?[")
+}
+
+// ParsePatterns splits a comma-delimited list of patterns, checking that globs and regular expressions are valid
+func ParsePatterns(value string) (Patterns, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	patterns := Patterns(strings.Split(value, ","))
+	for _, p := range patterns {
+		var err error
+		if strings.HasPrefix(p, RegexPatternPrefix) {
+			_, err = compilePattern(p)
+		} else if !IsLiteralPattern(p) {
+			_, err = path.Match(p, "")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return patterns, nil
+}
+
+// Match is true if the name matches any of the patterns
+func (p Patterns) Match(name string) bool {
+	for _, pattern := range p {
+		if strings.HasPrefix(pattern, RegexPatternPrefix) {
+			re, err := compilePattern(pattern)
+			if err == nil && re.MatchString(name) {
+				return true
+			}
+		} else if IsLiteralPattern(pattern) {
+			if pattern == name {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchOrEmpty is true if there are no patterns to filter on or the name matches one of them
+func (p Patterns) MatchOrEmpty(name string) bool {
+	return len(p) == 0 || p.Match(name)
+}
+
+// matchesGroups checks the groups of a directory against the group filters. With GroupsMatchAll every pattern has to
+// match at least one of the groups, otherwise any pattern matching any group is enough. A group matching an exclusion
+// rules the directory out either way.
+func (f FileFilter) matchesGroups(groups []string) bool {
+	for _, g := range groups {
+		if f.ExcludeGroups.Match(g) {
+			return false
+		}
+	}
+	if len(f.Groups) == 0 {
+		return true
+	}
+	if f.GroupsMatch == GroupsMatchAll {
+		for _, pattern := range f.Groups {
+			matched := false
+			for _, g := range groups {
+				if (Patterns{pattern}).Match(g) {
+					matched = true
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+		return true
+	}
+	for _, g := range groups {
+		if f.Groups.Match(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesUpdated checks the time a file was modified on the server against since and until
+func (f FileFilter) matchesUpdated(updated time.Time) bool {
+	return (f.Since == nil || !updated.Before(*f.Since)) && (f.Until == nil || updated.Before(*f.Until))
+}
+
+// matchesItem checks the update time, data date and size of an item against the filters
+func (f FileFilter) matchesItem(item *ExtractItem) bool {
+	return f.matchesUpdated(time.UnixMilli(item.Modified).UTC()) && f.matchesPeriod(item.DataDate) && f.matchesSize(item.Size)
+}
+
+// matchesSize checks the size of a file against the size limits
+func (f FileFilter) matchesSize(size int64) bool {
+	return (f.MinSize == 0 || size >= f.MinSize) && (f.MaxSize == 0 || size <= f.MaxSize)
+}
+
+// matchesPeriod checks the data date of a file against the period filters. Files without a data date in their name
+// can't be placed in a period, so they never match when a period is given.
+func (f FileFilter) matchesPeriod(dataDate time.Time) bool {
+	if f.PeriodFrom == nil && f.PeriodTo == nil {
+		return true
+	}
+	if dataDate.IsZero() {
+		return false
+	}
+	return (f.PeriodFrom == nil || !dataDate.Before(*f.PeriodFrom)) && (f.PeriodTo == nil || !dataDate.After(*f.PeriodTo))
+}
+
+// SortFiles sorts the files in place by name, size, time updated or dataset, from smallest or oldest to largest or
+// newest unless reversed. Files that are equal are sorted by dataset and name so the order is the same on every run.
+func SortFiles(files []ExtractFile, by string, reverse bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if reverse {
+			a, b = b, a
+		}
+		switch by {
+		case SortSize:
+			if a.Item.Size != b.Item.Size {
+				return a.Item.Size < b.Item.Size
+			}
+		case SortUpdated:
+			if !a.Updated.Equal(b.Updated) {
+				return a.Updated.Before(b.Updated)
+			}
+		case SortName:
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+		}
+		if a.Dataset != b.Dataset {
+			return a.Dataset < b.Dataset
+		}
+		return a.Name < b.Name
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPatterns(t *testing.T) {
+	t.Run("should match names, globs and regular expressions", func(t *testing.T) {
+		patterns, err := ParsePatterns("stnet,desktop_2022-0[34]-*,re:^i(OS|Pad)_")
+		assert.Nil(t, err)
+		assert.True(t, patterns.Match("stnet"))
+		assert.False(t, patterns.Match("stnet_2022-05-01.zip"))
+		assert.True(t, patterns.Match("desktop_2022-04-01.zip"))
+		assert.False(t, patterns.Match("desktop_2022-05-01.zip"))
+		assert.True(t, patterns.Match("iOS_2022-05-01.zip"))
+		assert.False(t, patterns.Match("android_iOS_2022-05-01.zip"))
+	})
+
+	t.Run("should match everything when there are no patterns", func(t *testing.T) {
+		patterns, err := ParsePatterns("")
+		assert.Nil(t, err)
+		assert.True(t, patterns.MatchOrEmpty("stnet"))
+		assert.False(t, patterns.Match("stnet"))
+	})
+
+	t.Run("should reject invalid patterns", func(t *testing.T) {
+		_, err := ParsePatterns("re:stnet_(")
+		assert.ErrorContains(t, err, `invalid pattern "re:stnet_("`)
+		_, err = ParsePatterns("stnet_[")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestFilterExpressions(t *testing.T) {
+	extracts, _ := GetTestExtracts()
+	names := func(files []ExtractFile) []string {
+		result := make([]string, 0, len(files))
+		for _, f := range files {
+			result = append(result, f.Name)
+		}
+		return result
+	}
+
+	t.Run("should filter with globs and regular expressions", func(t *testing.T) {
+		files := FilterFiles(extracts, FileFilter{Groups: Patterns{"re:^(android|iOS)$"}, Filenames: Patterns{"*_2022-05-*"}}, nil)
+		assert.ElementsMatch(t, []string{"android_2022-05-01.zip", "android_2022-05-01.zip", "iOS_2022-05-01.zip", "iOS_2022-05-01.zip"}, names(files))
+	})
+
+	t.Run("should exclude matching files even if they are included", func(t *testing.T) {
+		files := FilterFiles(extracts, FileFilter{Groups: Patterns{"native"}, ExcludeDatasets: Patterns{"cli"}, Latest: 1}, nil)
+		assert.Equal(t, []string{"desktop_2022-05-01.zip"}, names(files))
+
+		files = FilterFiles(extracts, FileFilter{ExcludeGroups: Patterns{"native", "web"}, ExcludeFilenames: Patterns{"*_2022-03-01.zip"}}, nil)
+		assert.Len(t, files, 8)
+		for _, f := range files {
+			assert.Contains(t, []string{"android", "iOS"}, f.Dataset)
+			assert.NotContains(t, f.Name, "2022-03-01")
+		}
+	})
+
+	t.Run("should require every group pattern to match with groups-match all", func(t *testing.T) {
+		stnet := &ExtractItem{Name: "stnet_2022-05-01.zip", Type: "file"}
+		cli := &ExtractItem{Name: "cli_2022-05-01.zip", Type: "file"}
+		items := []*ExtractItem{
+			{Type: "dir", Groups: []string{"native", "mobile"}, Datasets: map[string][]*ExtractItem{"stnet": {stnet}}},
+			{Type: "dir", Groups: []string{"native", "desktop"}, Datasets: map[string][]*ExtractItem{"cli": {cli}}},
+		}
+		files := FilterFiles(items, FileFilter{Groups: Patterns{"native", "mobile"}}, nil)
+		assert.ElementsMatch(t, []string{"stnet_2022-05-01.zip", "cli_2022-05-01.zip"}, names(files))
+		files = FilterFiles(items, FileFilter{Groups: Patterns{"native", "mobile"}, GroupsMatch: GroupsMatchAll}, nil)
+		assert.Equal(t, []string{"stnet_2022-05-01.zip"}, names(files))
+		files = FilterFiles(items, FileFilter{Groups: Patterns{"native", "mobile"}, GroupsMatch: GroupsMatchAll, ExcludeGroups: Patterns{"mob*"}}, nil)
+		assert.Empty(t, files)
+	})
+
+	t.Run("should filter for files modified within a range", func(t *testing.T) {
+		since := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+		until := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+		files := FilterFiles(extracts, FileFilter{Since: &since, Until: &until}, nil)
+		assert.Len(t, files, 8)
+		for _, f := range files {
+			assert.True(t, !f.Updated.Before(since) && f.Updated.Before(until))
+		}
+	})
+
+	t.Run("should filter for files within a size range", func(t *testing.T) {
+		files := FilterFiles(extracts, FileFilter{MinSize: 608, MaxSize: 705}, nil)
+		assert.Len(t, files, 12)
+		for _, f := range files {
+			assert.True(t, f.Item.Size >= 608 && f.Item.Size <= 705)
+		}
+		assert.Len(t, FilterFiles(extracts, FileFilter{MinSize: 706}, nil), 8)
+	})
+}
+
+func TestSortFiles(t *testing.T) {
+	file := func(dataset string, name string, size int64, updated string) ExtractFile {
+		date, _ := time.Parse("2006-01-02", updated)
+		return ExtractFile{Dataset: dataset, Name: name, Updated: date, Item: &ExtractItem{Name: name, Size: size}}
+	}
+	names := func(files []ExtractFile) []string {
+		result := make([]string, 0, len(files))
+		for _, f := range files {
+			result = append(result, f.Name)
+		}
+		return result
+	}
+	files := []ExtractFile{
+		file("stnet", "stnet_2022-05-01.zip", 300, "2022-06-01"),
+		file("cli", "cli_2022-05-01.zip", 100, "2022-06-02"),
+		file("stnet", "stnet_2022-04-01.zip", 200, "2022-05-01"),
+		file("android", "android_2022-05-01.zip", 200, "2022-06-01"),
+	}
+
+	t.Run("should sort by size", func(t *testing.T) {
+		SortFiles(files, SortSize, false)
+		assert.Equal(t, []string{"cli_2022-05-01.zip", "android_2022-05-01.zip", "stnet_2022-04-01.zip", "stnet_2022-05-01.zip"}, names(files))
+		SortFiles(files, SortSize, true)
+		assert.Equal(t, []string{"stnet_2022-05-01.zip", "stnet_2022-04-01.zip", "android_2022-05-01.zip", "cli_2022-05-01.zip"}, names(files))
+	})
+
+	t.Run("should sort by updated time", func(t *testing.T) {
+		SortFiles(files, SortUpdated, false)
+		assert.Equal(t, []string{"stnet_2022-04-01.zip", "android_2022-05-01.zip", "stnet_2022-05-01.zip", "cli_2022-05-01.zip"}, names(files))
+	})
+
+	t.Run("should sort by dataset and name", func(t *testing.T) {
+		SortFiles(files, SortDataset, false)
+		assert.Equal(t, []string{"android_2022-05-01.zip", "cli_2022-05-01.zip", "stnet_2022-04-01.zip", "stnet_2022-05-01.zip"}, names(files))
+		SortFiles(files, SortName, true)
+		assert.Equal(t, []string{"stnet_2022-05-01.zip", "stnet_2022-04-01.zip", "cli_2022-05-01.zip", "android_2022-05-01.zip"}, names(files))
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Layers of the config, from lowest to highest precedence. Each layer only replaces the values it sets.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceProfile = "profile"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// ConfigEnvPrefix starts the name of the environment variable for each config field, e.g. SPEEDTEST_STORAGE_DIRECTORY.
+// Nested fields are separated by a double underscore, e.g. SPEEDTEST_STORAGE__BUCKET for storage.bucket.
+const ConfigEnvPrefix = "SPEEDTEST_"
+
+// configFlagCategory groups the config flags in --help, apart from the other global options
+const configFlagCategory = "CONFIG OVERRIDES"
+
+// configFlagUsage replaces the generated usage of the config flags that need more explanation
+var configFlagUsage = map[string]string{
+	"limit_rate":    "Limit the combined download rate of all workers in bytes per second, e.g. 500K or 50M",
+	"path_template": "Lay out downloaded files using a Go text/template instead of --use-file-hierarchy, e.g. '{{.Dataset}}/{{date \"2006\" .Date}}/{{.Name}}', or hive for dataset=<dataset>/year=<yyyy>/month=<mm>/",
+}
+
+// secretFields are redacted when the config is shown or logged. The api secret command is included since it often
+// carries a token or the secret itself.
+var secretFields = []string{"api_secret", "api_secret_command", "storage.secret_access_key", "storage.private_key_passphrase"}
+
+// apiSecretFields are the sources of the api secret. A layer that sets one of them replaces all of them, since the
+// lower layers might otherwise take precedence in ResolveCredentials.
+var apiSecretFields = []string{"api_secret", "api_secret_file", "api_secret_command"}
+
+// ConfigField is a value in the config that can be set by each layer. Nested fields such as storage.type are named
+// by their path in the config file, and keep the dot in their flag, e.g. --storage.type, so that storage.directory
+// and storage_directory don't collide.
+type ConfigField struct {
+	Key   string
+	Flag  string
+	Env   string
+	index []int
+}
+
+// ConfigLayer holds the values a layer sets, keyed by ConfigField.Key
+type ConfigLayer struct {
+	Source string
+	Values map[string]string
+}
+
+var configFields = buildConfigFields(reflect.TypeOf(Config{}), "", nil)
+
+// buildConfigFields lists the fields of the config from their yaml tags. Profiles aren't included since they select
+// between sets of values rather than being a value themselves.
+func buildConfigFields(t reflect.Type, prefix string, index []int) []ConfigField {
+	fields := make([]ConfigField, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if len(name) == 0 || name == "-" || name == "profiles" {
+			continue
+		}
+		key := prefix + name
+		fieldIndex := append(append([]int{}, index...), i)
+		fieldType := f.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct {
+			fields = append(fields, buildConfigFields(fieldType, key+".", fieldIndex)...)
+			continue
+		}
+		fields = append(fields, ConfigField{
+			Key:   key,
+			Flag:  strings.ReplaceAll(key, "_", "-"),
+			Env:   ConfigEnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "__")),
+			index: fieldIndex,
+		})
+	}
+	return fields
+}
+
+// ConfigFlags are the global flags that override each config field, which can also be set with its environment
+// variable
+func ConfigFlags() []cli.Flag {
+	flags := make([]cli.Flag, 0, len(configFields))
+	for _, f := range configFields {
+		usage, ok := configFlagUsage[f.Key]
+		if !ok {
+			usage = fmt.Sprintf("Overrides %s in the config file", f.Key)
+		}
+		flags = append(flags, &cli.StringFlag{
+			Name:     f.Flag,
+			Usage:    usage,
+			EnvVars:  []string{f.Env},
+			Category: configFlagCategory,
+		})
+	}
+	return flags
+}
+
+// EnvLayer reads the config fields set in the environment
+func EnvLayer() ConfigLayer {
+	layer := ConfigLayer{Source: SourceEnv, Values: make(map[string]string)}
+	for _, f := range configFields {
+		if value, ok := os.LookupEnv(f.Env); ok && len(value) > 0 {
+			layer.Values[f.Key] = value
+		}
+	}
+	return layer
+}
+
+// FlagLayer reads the config fields given on the command line. The flags are also set from the environment, so a
+// value that matches the environment variable is left to the env layer.
+func FlagLayer(context *cli.Context) ConfigLayer {
+	layer := ConfigLayer{Source: SourceFlag, Values: make(map[string]string)}
+	for _, f := range configFields {
+		if context.IsSet(f.Flag) {
+			value := context.String(f.Flag)
+			if env, ok := os.LookupEnv(f.Env); !ok || env != value {
+				layer.Values[f.Key] = value
+			}
+		}
+	}
+	return layer
+}
+
+// setFileSources records the config fields that are set in the config file
+func (c *Config) setFileSources(contents []byte) {
+	var values map[string]interface{}
+	if yaml.Unmarshal(contents, &values) != nil {
+		return
+	}
+	keys := make([]string, 0)
+	for key, value := range values {
+		if nested, ok := value.(map[interface{}]interface{}); ok {
+			for nestedKey := range nested {
+				keys = append(keys, fmt.Sprintf("%s.%v", key, nestedKey))
+			}
+		}
+		keys = append(keys, key)
+	}
+	for _, f := range configFields {
+		if contains(f.Key, keys) {
+			c.setSource(f.Key, SourceFile)
+		}
+	}
+}
+
+// apply sets the values of the layer on the config, recording the layer as their source
+func (layer ConfigLayer) apply(c *Config) error {
+	for _, secret := range apiSecretFields {
+		if _, ok := layer.Values[secret]; ok {
+			c.ApiSecret, c.ApiSecretFile, c.ApiSecretCommand = "", "", ""
+			for _, key := range apiSecretFields {
+				delete(c.sources, key)
+			}
+			break
+		}
+	}
+	for _, f := range configFields {
+		value, ok := layer.Values[f.Key]
+		if !ok {
+			continue
+		}
+		err := f.set(c, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s from %s: %w", f.Key, layer.describe(f), err)
+		}
+		c.setSource(f.Key, layer.Source)
+	}
+	return nil
+}
+
+func (layer ConfigLayer) describe(f ConfigField) string {
+	if layer.Source == SourceEnv {
+		return f.Env
+	} else if layer.Source == SourceFlag {
+		return "--" + f.Flag
+	}
+	return layer.Source
+}
+
+// set parses the value into the field, allocating the struct it belongs to if needed. Lists and maps such as
+// rate_schedule and column_types are given as yaml, e.g. [{start: "22:00", end: "06:00", limit: 50M}].
+func (f ConfigField) set(c *Config, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	defaults := reflect.ValueOf(DefaultConfig)
+	for n, i := range f.index {
+		v = v.Field(i)
+		if n < len(f.index)-1 {
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					//start from the defaults so the fields that aren't set keep them
+					v.Set(reflect.New(v.Type().Elem()))
+					if d := defaults.Field(i); d.Kind() == reflect.Ptr && !d.IsNil() && n == 0 {
+						v.Elem().Set(d.Elem())
+					}
+				}
+				v = v.Elem()
+			}
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64:
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(number)
+	case reflect.Float64:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(number)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		parsed := reflect.New(v.Type())
+		err := yaml.UnmarshalStrict([]byte(value), parsed.Interface())
+		if err != nil {
+			return err
+		}
+		v.Set(parsed.Elem())
+	}
+	return nil
+}
+
+// get formats the value of the field, empty if it or the struct it belongs to isn't set
+func (f ConfigField) get(c *Config) string {
+	v := reflect.ValueOf(c).Elem()
+	for _, i := range f.index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return ""
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Int, reflect.Int64, reflect.Float64, reflect.Bool:
+		return fmt.Sprint(v.Interface())
+	default:
+		if v.Len() == 0 {
+			return ""
+		}
+		out, _ := yaml.Marshal(v.Interface())
+		return strings.TrimSpace(string(out))
+	}
+}
+
+// setSource records the layer that supplied a value
+func (c *Config) setSource(key string, source string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	c.sources[key] = source
+}
+
+// Source returns the layer that supplied the value of a config field
+func (c *Config) Source(key string) string {
+	if source, ok := c.sources[key]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// redactValue hides secrets in a value shown to the user
+func redactValue(key string, value string) string {
+	if len(value) > 0 && contains(key, secretFields) {
+		return redacted
+	}
+	if key == "load_dsn" {
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+	}
+	return value
+}
+
+// ConfigSources lists each config field with its value and the layer that supplied it, with secrets redacted
+func ConfigSources(c *Config) [][3]string {
+	sources := make([][3]string, 0, len(configFields))
+	for _, f := range configFields {
+		sources = append(sources, [3]string{f.Key, redactValue(f.Key, f.get(c)), c.Source(f.Key)})
+	}
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i][0] < sources[j][0]
+	})
+	return sources
+}
+
+// LogConfigSources logs where each config value came from, to help work out which layer is overriding a value
+func LogConfigSources(c *Config) {
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	for _, source := range ConfigSources(c) {
+		log.WithFields(log.Fields{
+			"profile": c.Profile,
+			"source":  source[2],
+		}).Debug(fmt.Sprintf("config %s = %s", source[0], source[1]))
+	}
+}
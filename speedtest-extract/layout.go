@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// HivePathTemplate partitions files by dataset and date, as expected by Hive style readers such as Spark and DuckDB
+const HivePathTemplate = `dataset={{.Dataset}}/year={{date "2006" .Date}}/month={{date "01" .Date}}/{{.Name}}`
+
+// pathTemplate lays out downloaded files in place of --use-file-hierarchy when a path template is configured
+var pathTemplate *template.Template
+
+// PathData is what a path template is evaluated against for each file
+type PathData struct {
+	Groups   []string
+	Dataset  string
+	Name     string
+	Date     time.Time
+	Modified time.Time
+}
+
+func NewPathData(f ExtractFile) PathData {
+	return PathData{
+		Groups:   f.Item.Groups,
+		Dataset:  f.Dataset,
+		Name:     f.Name,
+		Date:     FileDate(f),
+		Modified: time.UnixMilli(f.Item.Modified).UTC(),
+	}
+}
+
+// FileDate returns the date of the data in a file, falling back to the date it was updated
+func FileDate(f ExtractFile) time.Time {
+	if !f.DataDate.IsZero() {
+		return f.DataDate
+	}
+	if date, ok := ParseDataDate(f.Name); ok {
+		return date
+	}
+	return f.Updated.UTC().Truncate(24 * time.Hour)
+}
+
+// ParsePathTemplate parses a path template, using the same functions as list templates
+func ParsePathTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("path_template").Funcs(TemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// ExecutePathTemplate returns the slash separated path for the file, which must stay within the storage
+func ExecutePathTemplate(tmpl *template.Template, f ExtractFile) (string, error) {
+	var out strings.Builder
+	err := tmpl.Execute(&out, NewPathData(f))
+	if err != nil {
+		return "", fmt.Errorf("invalid path template: %w", err)
+	}
+	result := strings.TrimSpace(out.String())
+	name := path.Clean(result)
+	if name == "." || strings.HasSuffix(result, "/") {
+		return "", fmt.Errorf("path template gives an empty file name for %s", f.Name)
+	} else if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("path template gives %s for %s, which is outside the storage directory", name, f.Name)
+	}
+	return name, nil
+}
+
+// ValidatePathTemplate evaluates the template for every file up front, so a bad template fails before anything is
+// downloaded and two files can never be written to the same path
+func ValidatePathTemplate(tmpl *template.Template, files []ExtractFile) error {
+	paths := make(map[string]ExtractFile, len(files))
+	for _, f := range files {
+		name, err := ExecutePathTemplate(tmpl, f)
+		if err != nil {
+			return err
+		}
+		if other, ok := paths[name]; ok && other.Item != f.Item {
+			return fmt.Errorf("path template gives the same path %s for %s and %s, include more of the file details such as {{.Name}} or {{join \"/\" .Groups}}",
+				name, other.StateKey(), f.StateKey())
+		}
+		paths[name] = f
+	}
+	return nil
+}
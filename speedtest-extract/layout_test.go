@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPathTemplate(t *testing.T) {
+	may := ExtractFile{
+		Dataset: "stnet",
+		Name:    "stnet_2022-05-01.zip",
+		Updated: time.Date(2022, 5, 3, 12, 0, 0, 0, time.UTC),
+		Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Modified: time.Date(2022, 5, 3, 12, 0, 0, 0, time.UTC).UnixMilli(), Groups: []string{"native", "mobile"}},
+	}
+	june := ExtractFile{
+		Dataset: "stnet",
+		Name:    "stnet_2022-06-01.zip",
+		Item:    &ExtractItem{Name: "stnet_2022-06-01.zip", Groups: []string{"native", "mobile"}},
+	}
+	web := ExtractFile{
+		Dataset: "stnet",
+		Name:    "stnet_2022-05-01.zip",
+		Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Groups: []string{"web"}},
+	}
+
+	t.Run("should lay out hive partitions", func(t *testing.T) {
+		tmpl, err := ParsePathTemplate(HivePathTemplate)
+		assert.Nil(t, err)
+		name, err := ExecutePathTemplate(tmpl, may)
+		assert.Nil(t, err)
+		assert.Equal(t, "dataset=stnet/year=2022/month=05/stnet_2022-05-01.zip", name)
+	})
+
+	t.Run("should expose the file details", func(t *testing.T) {
+		tmpl, err := ParsePathTemplate(`{{join "-" .Groups}}/{{date "2006-01-02" .Modified}}/{{.Dataset}}_{{.Name}}`)
+		assert.Nil(t, err)
+		name, err := ExecutePathTemplate(tmpl, may)
+		assert.Nil(t, err)
+		assert.Equal(t, "native-mobile/2022-05-03/stnet_stnet_2022-05-01.zip", name)
+	})
+
+	t.Run("should fall back to the updated date", func(t *testing.T) {
+		file := ExtractFile{Name: "stnet_export.zip", Updated: time.Date(2022, 7, 4, 9, 30, 0, 0, time.UTC), Item: &ExtractItem{}}
+		assert.Equal(t, time.Date(2022, 7, 4, 0, 0, 0, 0, time.UTC), FileDate(file))
+	})
+
+	t.Run("should reject paths outside the storage directory", func(t *testing.T) {
+		for _, text := range []string{"../{{.Name}}", "/tmp/{{.Name}}", "{{.Dataset}}/", "{{.Missing}}"} {
+			tmpl, err := ParsePathTemplate(text)
+			if err == nil {
+				_, err = ExecutePathTemplate(tmpl, may)
+			}
+			assert.NotNil(t, err, text)
+		}
+	})
+
+	t.Run("should reject templates that map files to the same path", func(t *testing.T) {
+		tmpl, _ := ParsePathTemplate(HivePathTemplate)
+		assert.Nil(t, ValidatePathTemplate(tmpl, []ExtractFile{may, june, may}))
+		err := ValidatePathTemplate(tmpl, []ExtractFile{may, june, web})
+		assert.ErrorContains(t, err, "native/mobile/stnet_2022-05-01.zip and web/stnet_2022-05-01.zip")
+
+		tmpl, _ = ParsePathTemplate(`{{join "/" .Groups}}/{{.Name}}`)
+		assert.Nil(t, ValidatePathTemplate(tmpl, []ExtractFile{may, june, web}))
+	})
+
+	t.Run("should store files at the template path", func(t *testing.T) {
+		config.StorageDirectory = t.TempDir()
+		pathTemplate, _ = ParsePathTemplate(HivePathTemplate)
+		defer func() { pathTemplate = nil }()
+		assert.Equal(t, filepath.Join(config.StorageDirectory, "dataset=stnet", "year=2022", "month=05", "stnet_2022-05-01.zip"), localPath(t, may, false))
+		name, err := june.StoragePath(true)
+		assert.Nil(t, err)
+		assert.Equal(t, "dataset=stnet/year=2022/month=06/stnet_2022-06-01.zip", name)
+	})
+
+	t.Run("should fail the download when the template can't be executed for a file", func(t *testing.T) {
+		config.StorageDirectory = t.TempDir()
+		pathTemplate, _ = ParsePathTemplate(`{{index .Groups 2}}/{{.Name}}`)
+		defer func() { pathTemplate = nil }()
+		_, err := may.StoragePath(true)
+		assert.ErrorContains(t, err, "invalid path template")
+
+		file := ExtractFile{Dataset: "stnet", Name: "stnet_2022-05-01.zip", Item: &ExtractItem{Name: "stnet_2022-05-01.zip", Type: "file", Groups: []string{"web"}}}
+		result := file.Download(resty.New(), DownloadOptions{UseFileHierarchy: true})
+		assert.ErrorContains(t, result.err, "invalid path template")
+		assert.False(t, result.success)
+		entries, _ := os.ReadDir(config.StorageDirectory)
+		assert.Empty(t, entries, "nothing should be written elsewhere")
+	})
+}
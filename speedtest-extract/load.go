@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"io"
+	_ "modernc.org/sqlite"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	LoadAppend  = "append"
+	LoadReplace = "replace"
+)
+
+var LoadModes = []string{LoadAppend, LoadReplace}
+
+// LoadsTable records each file loaded into the database so reloading is idempotent
+const LoadsTable = "speedtest_extract_loads"
+
+// columns added to every dataset table to track where each row came from
+const (
+	fileColumn   = "_extract_file"
+	dateColumn   = "_extract_date"
+	groupsColumn = "_extract_groups"
+)
+
+type sqlDialect struct {
+	driver string
+	//copyIn loads rows with COPY rather than individual inserts
+	copyIn bool
+}
+
+var (
+	dialectSqlite   = sqlDialect{driver: "sqlite"}
+	dialectPostgres = sqlDialect{driver: "postgres", copyIn: true}
+)
+
+func (d sqlDialect) placeholder(n int) string {
+	if d.driver == dialectPostgres.driver {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func (d sqlDialect) columnType(columnType string) string {
+	switch columnType {
+	case ColumnInt64:
+		return "BIGINT"
+	case ColumnDouble:
+		return "DOUBLE PRECISION"
+	case ColumnBoolean:
+		return "BOOLEAN"
+	}
+	return "TEXT"
+}
+
+// Loader bulk loads the CSV data in extract files into a table per dataset
+type Loader struct {
+	db      *sql.DB
+	dialect sqlDialect
+	mode    string
+}
+
+// parseDsn picks the database driver from the DSN, which is either sqlite://<path> or a postgres:// connection url
+func parseDsn(dsn string) (sqlDialect, string, error) {
+	switch {
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return dialectSqlite, strings.TrimPrefix(dsn, "sqlite://"), nil
+	case strings.HasPrefix(dsn, "sqlite:"):
+		return dialectSqlite, strings.TrimPrefix(dsn, "sqlite:"), nil
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return dialectPostgres, dsn, nil
+	}
+	return sqlDialect{}, "", fmt.Errorf("unsupported dsn %q, expected sqlite://<path> or postgres://<url>", dsn)
+}
+
+// OpenLoader connects to the database and creates the bookkeeping table if needed
+func OpenLoader(dsn string, mode string) (*Loader, error) {
+	if !contains(mode, LoadModes) {
+		return nil, fmt.Errorf("unknown load mode %q, expected one of %s", mode, strings.Join(LoadModes, ", "))
+	}
+	dialect, source, err := parseDsn(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(dialect.driver, source)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == dialectSqlite {
+		//sqlite only allows a single writer
+		db.SetMaxOpenConns(1)
+	}
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		file_key TEXT PRIMARY KEY,
+		dataset TEXT NOT NULL,
+		table_name TEXT NOT NULL,
+		extract_date TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		mtime BIGINT NOT NULL,
+		row_count BIGINT NOT NULL,
+		loaded_at TEXT NOT NULL
+	)`, LoadsTable))
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("unable to create %s: %w", LoadsTable, err)
+	}
+	return &Loader{db: db, dialect: dialect, mode: mode}, nil
+}
+
+func (l *Loader) Close() error {
+	return l.db.Close()
+}
+
+// quoteIdentifier quotes a table or column name, which both sqlite and postgres accept
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlIdentifier turns a dataset or column name into a lowercase identifier that doesn't need quoting
+func sqlIdentifier(name string) string {
+	identifier := strings.Trim(columnNamePattern.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if len(identifier) == 0 || (identifier[0] >= '0' && identifier[0] <= '9') {
+		identifier = "_" + identifier
+	}
+	return identifier
+}
+
+// ExtractDate returns the date partition of a file, taken from its name or the date it was updated
+func ExtractDate(f ExtractFile) string {
+	return FileDate(f).Format("2006-01-02")
+}
+
+// fileGroups returns the slash separated groups of a loaded file from its key, e.g. native/mobile for
+// native/mobile/stnet_2022-05-01.zip. Several groups can share a dataset table, so replacing a date partition only
+// applies to the rows of the same groups.
+func fileGroups(fileKey string) string {
+	groups := path.Dir(fileKey)
+	if groups == "." {
+		return ""
+	}
+	return groups
+}
+
+// IsLoaded reports whether the file has already been loaded as it currently is on the server
+func (l *Loader) IsLoaded(f ExtractFile) (bool, error) {
+	var size, mtime int64
+	err := l.db.QueryRow(fmt.Sprintf("SELECT size, mtime FROM %s WHERE file_key = %s", LoadsTable, l.dialect.placeholder(1)), f.StateKey()).Scan(&size, &mtime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return size == f.Item.Size && mtime == f.Item.Modified, nil
+}
+
+// ensureTable creates the dataset table, adding any columns missing from an existing table
+func (l *Loader) ensureTable(tx *sql.Tx, name string, columns []Column) error {
+	definitions := []string{quoteIdentifier(fileColumn) + " TEXT NOT NULL", quoteIdentifier(dateColumn) + " TEXT NOT NULL", quoteIdentifier(groupsColumn) + " TEXT"}
+	for _, c := range columns {
+		definitions = append(definitions, quoteIdentifier(c.Name)+" "+l.dialect.columnType(c.Type))
+	}
+	_, err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteIdentifier(name), strings.Join(definitions, ", ")))
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", quoteIdentifier(name)))
+	if err != nil {
+		return err
+	}
+	existing, err := rows.Columns()
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+	if !contains(groupsColumn, existing) {
+		err = l.addGroupsColumn(tx, name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range columns {
+		if !contains(c.Name, existing) {
+			log.Info(fmt.Sprintf("Adding column %s to %s", c.Name, name))
+			_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quoteIdentifier(name), quoteIdentifier(c.Name), l.dialect.columnType(c.Type)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addGroupsColumn adds the groups column to a table created before it existed, filling it in from the file each row
+// was loaded from
+func (l *Loader) addGroupsColumn(tx *sql.Tx, name string) error {
+	log.Info(fmt.Sprintf("Adding column %s to %s", groupsColumn, name))
+	_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TEXT", quoteIdentifier(name), quoteIdentifier(groupsColumn)))
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(fmt.Sprintf("SELECT DISTINCT %s FROM %s", quoteIdentifier(fileColumn), quoteIdentifier(name)))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	_ = rows.Close()
+	for _, key := range keys {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s = %s", quoteIdentifier(name), quoteIdentifier(groupsColumn), l.dialect.placeholder(1), quoteIdentifier(fileColumn), l.dialect.placeholder(2)), fileGroups(key), key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceLoads removes the bookkeeping of the files in the same groups and date partition, whose rows are replaced
+func (l *Loader) replaceLoads(tx *sql.Tx, tableName string, date string, groups string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT file_key FROM %s WHERE table_name = %s AND extract_date = %s", LoadsTable, l.dialect.placeholder(1), l.dialect.placeholder(2)), tableName, date)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if fileGroups(key) == groups {
+			keys = append(keys, key)
+		}
+	}
+	_ = rows.Close()
+	for _, key := range keys {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE file_key = %s", LoadsTable, l.dialect.placeholder(1)), key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load replaces any rows previously loaded from the file, or from the same groups and date partition in replace mode,
+// with the contents of the downloaded file. Everything happens in a single transaction, so a failed load leaves the table as it
+// was. Returns the number of rows loaded.
+func (l *Loader) Load(f ExtractFile, fileName string) (int64, error) {
+	in, err := OpenCSV(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	table, err := NewCsvTable(in, config.ColumnTypes[f.Dataset])
+	if err != nil {
+		return 0, err
+	}
+	for i := range table.Columns {
+		table.Columns[i].Name = sqlIdentifier(table.Columns[i].Name)
+	}
+
+	tableName := sqlIdentifier(f.Dataset)
+	key := f.StateKey()
+	date := ExtractDate(f)
+	groups := fileGroups(key)
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = l.ensureTable(tx, tableName, table.Columns)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create table %s: %w", tableName, err)
+	}
+
+	if l.mode == LoadReplace {
+		log.Debug(fmt.Sprintf("replacing %s rows of %s for %s", tableName, groups, date))
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = %s AND %s = %s", quoteIdentifier(tableName), quoteIdentifier(dateColumn), l.dialect.placeholder(1), quoteIdentifier(groupsColumn), l.dialect.placeholder(2)), date, groups)
+		if err == nil {
+			err = l.replaceLoads(tx, tableName, date, groups)
+		}
+	} else {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = %s", quoteIdentifier(tableName), quoteIdentifier(fileColumn), l.dialect.placeholder(1)), key)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to remove previously loaded rows: %w", err)
+	}
+
+	rows, err := l.insertRows(tx, tableName, table, key, date, groups)
+	if err != nil {
+		return rows, err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE file_key = %s", LoadsTable, l.dialect.placeholder(1)), key)
+	if err != nil {
+		return rows, err
+	}
+	placeholders := make([]string, 8)
+	for i := range placeholders {
+		placeholders[i] = l.dialect.placeholder(i + 1)
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (file_key, dataset, table_name, extract_date, size, mtime, row_count, loaded_at) VALUES (%s)", LoadsTable, strings.Join(placeholders, ", ")),
+		key, f.Dataset, tableName, date, f.Item.Size, f.Item.Modified, rows, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return rows, fmt.Errorf("unable to record load of %s: %w", f.Name, err)
+	}
+	return rows, tx.Commit()
+}
+
+func (l *Loader) insertRows(tx *sql.Tx, tableName string, table *CsvTable, key string, date string, groups string) (int64, error) {
+	columns := []string{fileColumn, dateColumn, groupsColumn}
+	for _, c := range table.Columns {
+		columns = append(columns, c.Name)
+	}
+	var query string
+	if l.dialect.copyIn {
+		query = pq.CopyIn(tableName, columns...)
+	} else {
+		quoted := make([]string, len(columns))
+		placeholders := make([]string, len(columns))
+		for i, c := range columns {
+			quoted[i] = quoteIdentifier(c)
+			placeholders[i] = l.dialect.placeholder(i + 1)
+		}
+		query = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdentifier(tableName), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var rows int64
+	for {
+		row, err := table.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return rows, err
+		}
+		_, err = stmt.Exec(append([]interface{}{key, date, groups}, row...)...)
+		if err != nil {
+			return rows, err
+		}
+		rows += 1
+	}
+	if l.dialect.copyIn {
+		//an empty exec flushes the buffered COPY data
+		_, err = stmt.Exec()
+		if err != nil {
+			return rows, err
+		}
+	}
+	return rows, nil
+}
+
+// LoadFiles loads the downloaded copies of the given files, skipping files that haven't been downloaded or that were
+// already loaded unless force is set
+func LoadFiles(files []ExtractFile, dsn string, mode string, useFileHierarchy bool, force bool) error {
+	loader, err := OpenLoader(dsn, mode)
+	if err != nil {
+		return err
+	}
+	defer loader.Close()
+
+	loaded, skipped, errorCount := 0, 0, 0
+	for _, f := range files {
+		fileName, err := f.LocalPath(useFileHierarchy)
+		if err != nil {
+			log.WithError(err).Error(fmt.Sprintf("error loading %s", f.Name))
+			errorCount += 1
+			continue
+		}
+		if !fileExists(fileName) {
+			log.Debug(fmt.Sprintf("%s not found at %s, skipping", f.Name, fileName))
+			continue
+		}
+		if !force {
+			isLoaded, err := loader.IsLoaded(f)
+			if err != nil {
+				return fmt.Errorf("unable to read %s: %w", LoadsTable, err)
+			}
+			if isLoaded {
+				log.Info(fmt.Sprintf("%s already loaded, skipping. re-run with --force to load anyway", f.Name))
+				skipped += 1
+				continue
+			}
+		}
+		log.Info(fmt.Sprintf("Loading %s into %s", f.Name, sqlIdentifier(f.Dataset)))
+		rows, err := loader.Load(f, fileName)
+		if err != nil {
+			log.WithError(err).Error(fmt.Sprintf("error loading %s", f.Name))
+			errorCount += 1
+			continue
+		}
+		log.Debug(fmt.Sprintf("loaded %d rows from %s", rows, f.Name))
+		loaded += 1
+	}
+	if loaded+skipped+errorCount == 0 {
+		return ErrNoDownloadedFiles
+	}
+	log.Info(fmt.Sprintf("Loaded %d file(s), skipped %d already loaded file(s), encountered %d error(s)", loaded, skipped, errorCount))
+	if errorCount > 0 {
+		return fmt.Errorf("load completed with %d error(s)", errorCount)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	config.StorageDirectory = t.TempDir()
+	dbFile := filepath.Join(t.TempDir(), "extracts.db")
+	dsn := "sqlite://" + dbFile
+	file := func(name string, mtime int64, contents string) ExtractFile {
+		writeZip(t, filepath.Join(config.StorageDirectory, name), map[string]string{"data.csv": contents})
+		return ExtractFile{
+			Dataset: "stnet",
+			Name:    name,
+			Updated: time.Unix(mtime, 0),
+			Item:    &ExtractItem{Name: name, Modified: mtime, Size: int64(len(contents)), Groups: []string{"native"}},
+		}
+	}
+	count := func(query string, args ...interface{}) int {
+		db, err := sql.Open("sqlite", dbFile)
+		assert.Nil(t, err)
+		defer db.Close()
+		var n int
+		assert.Nil(t, db.QueryRow(query, args...).Scan(&n))
+		return n
+	}
+
+	t.Run("should create a table per dataset and record the load", func(t *testing.T) {
+		may := file("stnet_2022-05-01.zip", 100, "Test ID,Download Kbps\n1,1500.5\n2,900\n")
+		assert.Nil(t, LoadFiles([]ExtractFile{may}, dsn, LoadAppend, false, false))
+		assert.Equal(t, 2, count(`SELECT COUNT(*) FROM stnet WHERE _extract_date = '2022-05-01'`))
+		assert.Equal(t, 1, count(`SELECT COUNT(*) FROM speedtest_extract_loads WHERE file_key = 'native/stnet_2022-05-01.zip' AND row_count = 2`))
+		assert.Equal(t, 2, count(`SELECT SUM(test_id) - 1 FROM stnet`))
+	})
+
+	t.Run("should not load the same file twice", func(t *testing.T) {
+		may := file("stnet_2022-05-01.zip", 100, "Test ID,Download Kbps\n1,1500.5\n2,900\n")
+		assert.Nil(t, LoadFiles([]ExtractFile{may}, dsn, LoadAppend, false, false))
+		assert.Nil(t, LoadFiles([]ExtractFile{may}, dsn, LoadAppend, false, true))
+		assert.Equal(t, 2, count(`SELECT COUNT(*) FROM stnet`))
+	})
+
+	t.Run("should append other files and replace changed ones", func(t *testing.T) {
+		june := file("stnet_2022-06-01.zip", 200, "Test ID,Download Kbps,Is Wifi\n3,100,true\n")
+		assert.Nil(t, LoadFiles([]ExtractFile{june}, dsn, LoadAppend, false, false))
+		assert.Equal(t, 3, count(`SELECT COUNT(*) FROM stnet`))
+		assert.Equal(t, 1, count(`SELECT COUNT(*) FROM stnet WHERE is_wifi`))
+
+		june = file("stnet_2022-06-01.zip", 300, "Test ID,Download Kbps,Is Wifi\n3,100,true\n4,200,false\n")
+		assert.Nil(t, LoadFiles([]ExtractFile{june}, dsn, LoadAppend, false, false))
+		assert.Equal(t, 4, count(`SELECT COUNT(*) FROM stnet`))
+		assert.Equal(t, 2, count(`SELECT COUNT(*) FROM stnet WHERE _extract_date = ?`, "2022-06-01"))
+	})
+
+	t.Run("should replace the date partition of the same groups", func(t *testing.T) {
+		web := file("stnet_2022-06-01_web.zip", 350, "Test ID,Download Kbps\n6,20\n7,30\n")
+		web.Item.Groups = []string{"web"}
+		assert.Nil(t, LoadFiles([]ExtractFile{web}, dsn, LoadAppend, false, false))
+
+		fixed := file("stnet_2022-06-01_fixed.zip", 400, "Test ID,Download Kbps\n5,10\n")
+		assert.Nil(t, LoadFiles([]ExtractFile{fixed}, dsn, LoadReplace, false, false))
+		assert.Equal(t, 1, count(`SELECT COUNT(*) FROM stnet WHERE _extract_date = ? AND _extract_groups = ?`, "2022-06-01", "native"))
+		assert.Equal(t, 2, count(`SELECT COUNT(*) FROM stnet WHERE _extract_date = ? AND _extract_groups = ?`, "2022-06-01", "web"))
+		assert.Equal(t, 2, count(`SELECT COUNT(*) FROM stnet WHERE _extract_date = ?`, "2022-05-01"))
+		assert.Equal(t, 0, count(`SELECT COUNT(*) FROM speedtest_extract_loads WHERE file_key = 'native/stnet_2022-06-01.zip'`))
+		assert.Equal(t, 1, count(`SELECT COUNT(*) FROM speedtest_extract_loads WHERE file_key = 'web/stnet_2022-06-01_web.zip'`))
+	})
+
+	t.Run("should add the groups to tables loaded without them", func(t *testing.T) {
+		db, err := sql.Open("sqlite", dbFile)
+		assert.Nil(t, err)
+		_, err = db.Exec(`CREATE TABLE fixed (_extract_file TEXT NOT NULL, _extract_date TEXT NOT NULL, test_id BIGINT)`)
+		assert.Nil(t, err)
+		_, err = db.Exec(`INSERT INTO fixed VALUES ('web/fixed_2022-05-01.zip', '2022-05-01', 1), ('native/fixed_2022-05-01.zip', '2022-05-01', 2)`)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+
+		native := file("fixed_2022-05-01.zip", 500, "Test ID\n3\n")
+		native.Dataset = "fixed"
+		assert.Nil(t, LoadFiles([]ExtractFile{native}, dsn, LoadReplace, false, false))
+		assert.Equal(t, 1, count(`SELECT COUNT(*) FROM fixed WHERE _extract_groups = 'web' AND test_id = 1`))
+		assert.Equal(t, 1, count(`SELECT COUNT(*) FROM fixed WHERE _extract_groups = 'native' AND test_id = 3`))
+		assert.Equal(t, 2, count(`SELECT COUNT(*) FROM fixed`))
+	})
+
+	t.Run("should reject unknown targets", func(t *testing.T) {
+		_, err := OpenLoader("mysql://localhost/extracts", LoadAppend)
+		assert.NotNil(t, err)
+		_, err = OpenLoader(dsn, "merge")
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/jedib0t/go-pretty/v6/text"
+	"gopkg.in/yaml.v2"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OutputTable    = "table"
+	OutputMarkdown = "markdown"
+	OutputJson     = "json"
+	OutputNdjson   = "ndjson"
+	OutputCsv      = "csv"
+	OutputYaml     = "yaml"
+)
+
+var OutputFormats = []string{OutputTable, OutputMarkdown, OutputJson, OutputNdjson, OutputCsv, OutputYaml}
+
+// ListSchemaVersion is bumped whenever a field is renamed or removed from FileRecord. Adding fields doesn't change it,
+// so consumers should ignore fields they don't recognize.
+const ListSchemaVersion = 1
+
+// FileRecord is the machine-readable representation of an ExtractFile
+type FileRecord struct {
+	Groups  []string `json:"groups" yaml:"groups"`
+	Dataset string   `json:"dataset" yaml:"dataset"`
+	Name    string   `json:"name" yaml:"name"`
+	Size    int64    `json:"size" yaml:"size"`
+	Url     string   `json:"url" yaml:"url"`
+	Updated string   `json:"updated" yaml:"updated"`
+	Latest  bool     `json:"latest" yaml:"latest"`
+	//DataDate is the date of the data in the file as YYYY-MM-DD, or empty if the file name doesn't include one
+	DataDate string `json:"data_date" yaml:"data_date"`
+	//Profile is only set with --all-profiles
+	Profile string `json:"profile,omitempty" yaml:"profile,omitempty"`
+}
+
+type FileListing struct {
+	SchemaVersion int          `json:"schema_version" yaml:"schema_version"`
+	Files         []FileRecord `json:"files" yaml:"files"`
+}
+
+// ndjsonRecord carries the schema version on every line since there is no enclosing document
+type ndjsonRecord struct {
+	SchemaVersion int `json:"schema_version"`
+	FileRecord
+}
+
+var csvHeader = []string{"groups", "dataset", "name", "size", "url", "updated", "latest", "data_date", "profile"}
+
+func NewFileRecord(f ExtractFile) FileRecord {
+	groups := f.Item.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return FileRecord{
+		Groups:   groups,
+		Dataset:  f.Dataset,
+		Name:     f.Name,
+		Size:     f.Item.Size,
+		Url:      f.Item.Url,
+		Updated:  f.Updated.Format(time.RFC3339),
+		Latest:   f.Latest,
+		DataDate: formatDataDate(f.DataDate),
+		Profile:  f.Profile,
+	}
+}
+
+func formatDataDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format("2006-01-02")
+}
+
+func ValidateOutputFormat(format string) error {
+	if !contains(format, OutputFormats) {
+		return fmt.Errorf("unknown output format %q, expected one of %s", format, strings.Join(OutputFormats, ", "))
+	}
+	return nil
+}
+
+// WriteFiles renders the files in the given output format
+func WriteFiles(w io.Writer, files []ExtractFile, format string) error {
+	records := make([]FileRecord, 0, len(files))
+	for _, f := range files {
+		records = append(records, NewFileRecord(f))
+	}
+
+	switch format {
+	case OutputTable, OutputMarkdown:
+		t := filesTable(files)
+		t.SetOutputMirror(w)
+		if format == OutputMarkdown {
+			t.RenderMarkdown()
+		} else {
+			t.Render()
+		}
+	case OutputJson:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(FileListing{SchemaVersion: ListSchemaVersion, Files: records})
+	case OutputNdjson:
+		enc := json.NewEncoder(w)
+		for _, r := range records {
+			err := enc.Encode(ndjsonRecord{SchemaVersion: ListSchemaVersion, FileRecord: r})
+			if err != nil {
+				return err
+			}
+		}
+	case OutputCsv:
+		//groups are joined with "/" as in the extract hierarchy
+		out := csv.NewWriter(w)
+		_ = out.Write(csvHeader)
+		for _, r := range records {
+			_ = out.Write([]string{
+				strings.Join(r.Groups, "/"), r.Dataset, r.Name, strconv.FormatInt(r.Size, 10), r.Url, r.Updated, strconv.FormatBool(r.Latest), r.DataDate, r.Profile,
+			})
+		}
+		out.Flush()
+		return out.Error()
+	case OutputYaml:
+		out, err := yaml.Marshal(FileListing{SchemaVersion: ListSchemaVersion, Files: records})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	default:
+		return ValidateOutputFormat(format)
+	}
+	return nil
+}
+
+func filesTable(files []ExtractFile) table.Writer {
+	//the profile column is only shown when listing every profile
+	profiles := false
+	for _, f := range files {
+		if len(f.Profile) > 0 {
+			profiles = true
+		}
+	}
+	offset := 0
+	header := table.Row{"Groups", "Dataset", "File", "Size", "Data Date", "Updated", "Latest"}
+	if profiles {
+		offset = 1
+		header = append(table.Row{"Profile"}, header...)
+	}
+	t := table.NewWriter()
+	t.AppendHeader(header)
+	t.SetColumnConfigs([]table.ColumnConfig{
+		{Number: 1, AutoMerge: true},
+		{Number: 2, AutoMerge: true},
+		{Number: 3 + offset, AutoMerge: profiles},
+		{Number: 4 + offset, Align: text.AlignRight},
+	})
+	for _, f := range files {
+		latest := ""
+		if f.Latest {
+			latest = "*"
+		}
+		groups := strings.Join(f.Item.Groups, ", ")
+		row := table.Row{
+			groups, f.Dataset, f.Name, HumanSize(f.Item.Size), formatDataDate(f.DataDate), f.Updated, latest,
+		}
+		if profiles {
+			row = append(table.Row{f.Profile}, row...)
+		}
+		t.AppendRow(row)
+	}
+	return t
+}
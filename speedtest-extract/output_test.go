@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"strings"
+	"testing"
+)
+
+func TestWriteFiles(t *testing.T) {
+	extracts, _ := GetTestExtracts()
+	files := FilterFiles(extracts, FileFilter{Latest: 1}, nil)
+
+	t.Run("should write a versioned json document", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Nil(t, WriteFiles(&out, files, OutputJson))
+		var listing FileListing
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &listing))
+		assert.Equal(t, ListSchemaVersion, listing.SchemaVersion)
+		assert.Len(t, listing.Files, len(files))
+		assert.Equal(t, files[0].Name, listing.Files[0].Name)
+		assert.Equal(t, files[0].Item.Size, listing.Files[0].Size)
+		assert.Equal(t, files[0].DataDate.Format("2006-01-02"), listing.Files[0].DataDate)
+	})
+
+	t.Run("should write one json record per line", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Nil(t, WriteFiles(&out, files, OutputNdjson))
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		assert.Len(t, lines, len(files))
+		for _, line := range lines {
+			var record map[string]interface{}
+			assert.Nil(t, json.Unmarshal([]byte(line), &record))
+			assert.EqualValues(t, ListSchemaVersion, record["schema_version"])
+			assert.Contains(t, record, "dataset")
+		}
+	})
+
+	t.Run("should write csv with a header", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Nil(t, WriteFiles(&out, files, OutputCsv))
+		rows, err := csv.NewReader(&out).ReadAll()
+		assert.Nil(t, err)
+		assert.Len(t, rows, len(files)+1)
+		assert.Equal(t, csvHeader, rows[0])
+	})
+
+	t.Run("should write yaml", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Nil(t, WriteFiles(&out, files, OutputYaml))
+		var listing FileListing
+		assert.Nil(t, yaml.Unmarshal(out.Bytes(), &listing))
+		assert.Len(t, listing.Files, len(files))
+	})
+
+	t.Run("should add the profile when listing every profile", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Nil(t, WriteFiles(&out, files, OutputTable))
+		assert.NotContains(t, out.String(), "PROFILE")
+
+		profileFiles := append([]ExtractFile{}, files...)
+		for i := range profileFiles {
+			profileFiles[i].Profile = "emea"
+		}
+		out.Reset()
+		assert.Nil(t, WriteFiles(&out, profileFiles, OutputTable))
+		assert.Contains(t, out.String(), "PROFILE")
+		assert.Contains(t, out.String(), "emea")
+
+		out.Reset()
+		assert.Nil(t, WriteFiles(&out, profileFiles, OutputJson))
+		var listing FileListing
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &listing))
+		assert.Equal(t, "emea", listing.Files[0].Profile)
+	})
+
+	t.Run("should reject unknown formats", func(t *testing.T) {
+		assert.NotNil(t, WriteFiles(&bytes.Buffer{}, files, "xml"))
+	})
+}
+
+func TestWriteTemplate(t *testing.T) {
+	extracts, _ := GetTestExtracts()
+	files := FilterFiles(extracts, FileFilter{Groups: []string{"web"}, Latest: 1}, nil)
+
+	t.Run("should execute the template for each file", func(t *testing.T) {
+		tmpl, err := ParseListTemplate(`{{.Dataset}}\t{{.Item.Size | size}}\t{{join "/" .Item.Groups}}\t{{date "2006-01" .Updated}}\t{{date "2006-01" .DataDate}}`, "")
+		assert.Nil(t, err)
+		var out bytes.Buffer
+		assert.Nil(t, WriteTemplate(&out, files, tmpl, false))
+		assert.Equal(t, "stnet\t"+HumanSize(files[0].Item.Size)+"\tweb\t2022-06\t2022-05\n", out.String())
+	})
+
+	t.Run("should execute the template once for all files", func(t *testing.T) {
+		tmpl, err := ParseListTemplate(`{{len .}} file(s){{range .}} {{.Name}}{{end}}`, "")
+		assert.Nil(t, err)
+		var out bytes.Buffer
+		assert.Nil(t, WriteTemplate(&out, files, tmpl, true))
+		assert.Equal(t, "1 file(s) stnet_2022-05-01.zip", out.String())
+	})
+
+	t.Run("should keep escaped backslashes in the template", func(t *testing.T) {
+		tmpl, err := ParseListTemplate(`C:\\temp\\new\t{{.Name}}\n`, "")
+		assert.Nil(t, err)
+		var out bytes.Buffer
+		assert.Nil(t, WriteTemplate(&out, files, tmpl, false))
+		assert.Equal(t, `C:\temp\new`+"\tstnet_2022-05-01.zip\n", out.String())
+	})
+
+	t.Run("should format sizes", func(t *testing.T) {
+		assert.Equal(t, "1023 B", HumanSize(1023))
+		assert.Equal(t, "1.5 KiB", HumanSize(1536))
+		assert.Equal(t, "2.0 GiB", HumanSize(2*1024*1024*1024))
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Profile is a named account in the config file. Values that are set replace the ones at the top level of the config
+// file, so settings shared by every account only need to be given once.
+type Profile struct {
+	ApiKey           string         `yaml:"api_key,omitempty"`
+	ApiSecret        string         `yaml:"api_secret,omitempty"`
+	ApiSecretFile    string         `yaml:"api_secret_file,omitempty"`
+	ApiSecretCommand string         `yaml:"api_secret_command,omitempty"`
+	ExtractUrl       string         `yaml:"extract_url,omitempty"`
+	StorageDirectory string         `yaml:"storage_directory,omitempty"`
+	Storage          *StorageConfig `yaml:"storage,omitempty"`
+	//CacheFilename and StateFilename default to the top level file names with the profile name added, so accounts
+	//never share cached responses or download state
+	CacheFilename string `yaml:"cache_filename,omitempty"`
+	StateFilename string `yaml:"state_filename,omitempty"`
+}
+
+// ProfileNames returns the names of the profiles in the config file in alphabetical order
+func (config *Config) ProfileNames() []string {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ForProfile returns the config for the named profile, or the top level of the config file if name is empty, with the
+// layers applied over it, credentials resolved and defaults filled in
+func (config *Config) ForProfile(name string, configFile string, layers ...ConfigLayer) (*Config, error) {
+	c := *config
+	c.sources = make(map[string]string, len(config.sources))
+	for key, source := range config.sources {
+		c.sources[key] = source
+	}
+	if len(name) > 0 {
+		p, ok := config.Profiles[name]
+		if !ok || p == nil {
+			return nil, fmt.Errorf("profile %q not found in %s, expected one of %s", name, configFile, strings.Join(config.ProfileNames(), ", "))
+		}
+		c.applyProfile(name, p)
+	}
+	for _, layer := range layers {
+		err := layer.apply(&c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := c.resolve(configFile)
+	if errors.Is(err, ErrMissingAuth) && len(name) == 0 && len(config.Profiles) > 0 {
+		return nil, fmt.Errorf("%w, or choose a profile with --profile: %s", err, strings.Join(config.ProfileNames(), ", "))
+	} else if err != nil && len(name) > 0 {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	return &c, err
+}
+
+func (config *Config) applyProfile(name string, p *Profile) {
+	config.Profile = name
+	if len(p.ApiKey) > 0 {
+		config.ApiKey = p.ApiKey
+		config.setSource("api_key", SourceProfile)
+	}
+	//a secret set in the profile replaces every source of the secret at the top level, which might otherwise take
+	//precedence over it
+	if len(p.ApiSecret) > 0 || len(p.ApiSecretFile) > 0 || len(p.ApiSecretCommand) > 0 {
+		config.ApiSecret = p.ApiSecret
+		config.ApiSecretFile = p.ApiSecretFile
+		config.ApiSecretCommand = p.ApiSecretCommand
+		for _, key := range apiSecretFields {
+			delete(config.sources, key)
+		}
+		for key, value := range map[string]string{"api_secret": p.ApiSecret, "api_secret_file": p.ApiSecretFile, "api_secret_command": p.ApiSecretCommand} {
+			if len(value) > 0 {
+				config.setSource(key, SourceProfile)
+			}
+		}
+	}
+	if len(p.ExtractUrl) > 0 {
+		config.ExtractUrl = p.ExtractUrl
+		config.setSource("extract_url", SourceProfile)
+	}
+	if len(p.StorageDirectory) > 0 {
+		config.StorageDirectory = p.StorageDirectory
+		config.setSource("storage_directory", SourceProfile)
+	}
+	if p.Storage != nil {
+		config.Storage = p.Storage
+		for _, f := range configFields {
+			if strings.HasPrefix(f.Key, "storage.") {
+				config.setSource(f.Key, SourceProfile)
+			}
+		}
+	}
+	config.CacheFilename = profileFileName(p.CacheFilename, config.CacheFilename, DefaultConfig.CacheFilename, name)
+	config.StateFilename = profileFileName(p.StateFilename, config.StateFilename, DefaultConfig.StateFilename, name)
+	config.setSource("cache_filename", SourceProfile)
+	config.setSource("state_filename", SourceProfile)
+}
+
+// profileFileName returns the file name set in the profile, or else the top level one with the profile name added,
+// e.g. .extracts-state-emea.json
+func profileFileName(fileName string, shared string, defaultName string, profile string) string {
+	if len(fileName) > 0 {
+		return fileName
+	}
+	if len(shared) == 0 {
+		shared = defaultName
+	}
+	ext := filepath.Ext(shared)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(shared, ext), profile, ext)
+}
+
+// ReadAllProfiles reads the config for every profile in the config file, in alphabetical order, applying the
+// environment variables and the given layers over each of them
+func ReadAllProfiles(configFile string, layers ...ConfigLayer) ([]*Config, error) {
+	config, err := parseConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Profiles) == 0 {
+		return nil, fmt.Errorf("no profiles found in %s", configFile)
+	}
+	//credentials from the environment or flags can only belong to one of the accounts
+	layers = append([]ConfigLayer{EnvLayer()}, layers...)
+	for _, layer := range layers {
+		for _, f := range configFields {
+			if _, ok := layer.Values[f.Key]; ok && (f.Key == "api_key" || contains(f.Key, apiSecretFields)) {
+				return nil, fmt.Errorf("%s can't be used with --all-profiles, set the credentials of each profile in the config file", layer.describe(f))
+			}
+		}
+	}
+	profiles := make([]*Config, 0, len(config.Profiles))
+	for _, name := range config.ProfileNames() {
+		c, err := config.ForProfile(name, configFile, layers...)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, c)
+	}
+	return profiles, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/progress"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProgressAuto = "auto"
+	ProgressBars = "bars"
+	ProgressLog  = "log"
+	ProgressNone = "none"
+)
+
+var ProgressModes = []string{ProgressAuto, ProgressBars, ProgressLog, ProgressNone}
+
+// ProgressLogInterval is how often progress is logged when not showing progress bars
+var ProgressLogInterval = 10 * time.Second
+
+// ProgressReporter tracks the bytes downloaded for each file and overall, either as progress bars when attached to a
+// terminal or as periodic log lines otherwise
+type ProgressReporter struct {
+	writer   progress.Writer
+	overall  *progress.Tracker
+	interval time.Duration
+
+	total   atomic.Int64
+	written atomic.Int64
+	started time.Time
+
+	mu     sync.Mutex
+	active map[*FileProgress]bool
+	done   chan bool
+	wg     sync.WaitGroup
+}
+
+// FileProgress counts the bytes written for a single file download
+type FileProgress struct {
+	name     string
+	size     int64
+	written  atomic.Int64
+	started  time.Time
+	tracker  *progress.Tracker
+	reporter *ProgressReporter
+}
+
+func isTerminal(f *os.File) bool {
+	stats, err := f.Stat()
+	return err == nil && stats.Mode()&os.ModeCharDevice != 0
+}
+
+// NewProgressReporter starts reporting progress for downloading the given files. Returns nil when mode is none, which
+// is safe to use and reports nothing.
+func NewProgressReporter(files []ExtractFile, mode string, interval time.Duration) *ProgressReporter {
+	if mode == ProgressAuto {
+		mode = ProgressLog
+		if isTerminal(os.Stdout) {
+			mode = ProgressBars
+		}
+	}
+	if mode == ProgressNone {
+		return nil
+	}
+
+	p := &ProgressReporter{
+		interval: interval,
+		started:  time.Now(),
+		active:   make(map[*FileProgress]bool),
+		done:     make(chan bool),
+	}
+	for _, f := range files {
+		p.total.Add(f.Item.Size)
+	}
+
+	if mode == ProgressBars {
+		p.writer = progress.NewWriter()
+		p.writer.SetOutputWriter(os.Stdout)
+		p.writer.SetAutoStop(false)
+		p.writer.SetTrackerLength(25)
+		p.writer.SetMessageLength(40)
+		p.writer.SetUpdateFrequency(250 * time.Millisecond)
+		p.writer.SetSortBy(progress.SortByNone)
+		p.writer.Style().Visibility.ETA = true
+		p.writer.Style().Visibility.Speed = true
+		p.writer.Style().Visibility.Value = true
+		p.overall = &progress.Tracker{Message: fmt.Sprintf("Total (%d files)", len(files)), Total: p.total.Load(), Units: progress.UnitsBytes}
+		p.writer.AppendTracker(p.overall)
+		//log messages would otherwise be overwritten by the progress bars, print them above the bars instead
+		log.SetOutput(progressLogWriter{p.writer})
+		go p.writer.Render()
+	} else {
+		p.wg.Add(1)
+		go p.logProgress()
+	}
+	return p
+}
+
+// Stop finishes reporting, rendering the final state of the progress bars
+func (p *ProgressReporter) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+	if p.writer != nil {
+		if p.overall.Value() >= p.overall.Total {
+			p.overall.MarkAsDone()
+		}
+		//give the writer a chance to render the final state before stopping it
+		time.Sleep(300 * time.Millisecond)
+		p.writer.Stop()
+		for p.writer.IsRenderInProgress() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// Start begins tracking a file download, resuming from offset if some of the file already exists
+func (p *ProgressReporter) Start(file ExtractFile, offset int64) *FileProgress {
+	if p == nil {
+		return nil
+	}
+	f := &FileProgress{name: file.Name, size: file.Item.Size, started: time.Now(), reporter: p}
+	if p.writer != nil {
+		f.tracker = &progress.Tracker{Message: file.Name, Total: file.Item.Size, Units: progress.UnitsBytes}
+		p.writer.AppendTracker(f.tracker)
+	}
+	p.mu.Lock()
+	p.active[f] = true
+	p.mu.Unlock()
+	f.Reset(offset)
+	return f
+}
+
+// Skip removes a file that won't be downloaded from the overall total
+func (p *ProgressReporter) Skip(file ExtractFile) {
+	if p == nil {
+		return
+	}
+	p.total.Add(-file.Item.Size)
+	if p.overall != nil {
+		p.overall.UpdateTotal(p.total.Load())
+	}
+}
+
+func (p *ProgressReporter) add(n int64) {
+	p.written.Add(n)
+	if p.overall != nil {
+		p.overall.Increment(n)
+	}
+}
+
+func (p *ProgressReporter) logProgress() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.logOnce()
+		}
+	}
+}
+
+// logOnce logs the progress of each active file and overall. The numbers are part of the message since the default
+// log format only prints the message.
+func (p *ProgressReporter) logOnce() {
+	p.mu.Lock()
+	for f := range p.active {
+		log.Info(fmt.Sprintf("Downloading %s: %s", f.name, progressMessage(f.written.Load(), f.size, time.Since(f.started))))
+	}
+	p.mu.Unlock()
+	log.Info(fmt.Sprintf("Download progress: %s", progressMessage(p.written.Load(), p.total.Load(), time.Since(p.started))))
+}
+
+// progressMessage describes the progress of a transfer, e.g. "1.5 MiB of 3.0 MiB (50.0%), 512.0 KiB/s, ETA 3s"
+func progressMessage(written int64, total int64, elapsed time.Duration) string {
+	message := fmt.Sprintf("%s of %s", HumanSize(written), HumanSize(total))
+	if total > 0 {
+		message += fmt.Sprintf(" (%.1f%%)", float64(written)/float64(total)*100)
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		rate := float64(written) / seconds
+		message += fmt.Sprintf(", %s/s", HumanSize(int64(rate)))
+		if rate > 0 && total > written {
+			message += fmt.Sprintf(", ETA %s", (time.Duration(float64(total-written)/rate) * time.Second).Round(time.Second))
+		}
+	}
+	return message
+}
+
+func (f *FileProgress) Write(b []byte) (int, error) {
+	if f != nil {
+		f.written.Add(int64(len(b)))
+		if f.tracker != nil {
+			f.tracker.Increment(int64(len(b)))
+		}
+		f.reporter.add(int64(len(b)))
+	}
+	return len(b), nil
+}
+
+// Reset sets the number of bytes already downloaded, e.g. when a download restarts or resumes
+func (f *FileProgress) Reset(offset int64) {
+	if f == nil {
+		return
+	}
+	previous := f.written.Swap(offset)
+	if f.tracker != nil {
+		f.tracker.SetValue(offset)
+	}
+	f.reporter.add(offset - previous)
+}
+
+// Done stops tracking the file, marking it as failed if err is set
+func (f *FileProgress) Done(err error) {
+	if f == nil {
+		return
+	}
+	f.reporter.mu.Lock()
+	delete(f.reporter.active, f)
+	f.reporter.mu.Unlock()
+	if err != nil {
+		//the bytes for a failed file will never arrive, keep the overall total reachable
+		f.reporter.total.Add(f.written.Load() - f.size)
+		if f.reporter.overall != nil {
+			f.reporter.overall.UpdateTotal(f.reporter.total.Load())
+		}
+	}
+	if f.tracker != nil {
+		if err != nil {
+			f.tracker.MarkAsErrored()
+		} else {
+			f.tracker.MarkAsDone()
+		}
+	}
+}
+
+type progressLogWriter struct {
+	writer progress.Writer
+}
+
+func (w progressLogWriter) Write(b []byte) (int, error) {
+	w.writer.Log(strings.TrimRight(string(b), "\n"))
+	return len(b), nil
+}
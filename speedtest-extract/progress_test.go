@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	easy "github.com/t-tomalak/logrus-easy-formatter"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	content := []byte(strings.Repeat("speedtest extract contents ", 64))
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.ServeContent(res, req, "stnet_2022-05-01.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	newFile := func(name string) ExtractFile {
+		return ExtractFile{Dataset: "stnet", Name: name, Item: &ExtractItem{Name: name, Url: server.URL, Type: "file", Size: int64(len(content))}}
+	}
+
+	t.Run("should count resumed files and leave out skipped ones", func(t *testing.T) {
+		config.StorageDirectory = t.TempDir()
+		files := []ExtractFile{newFile("stnet_2022-04-01.zip"), newFile("stnet_2022-05-01.zip")}
+		assert.Nil(t, os.WriteFile(localPath(t, files[0], false), content, 0644))
+		assert.Nil(t, os.WriteFile(localPath(t, files[1], false)+PartialFileSuffix, content[:100], 0644))
+
+		reporter := NewProgressReporter(files, ProgressLog, time.Millisecond)
+		for _, f := range files {
+			result := f.Download(resty.New(), DownloadOptions{Progress: reporter})
+			assert.Nil(t, result.err)
+		}
+		reporter.Stop()
+
+		assert.Equal(t, int64(len(content)), reporter.total.Load(), "skipped files should be removed from the total")
+		assert.Equal(t, int64(len(content)), reporter.written.Load(), "resumed bytes should count towards progress")
+		assert.Empty(t, reporter.active)
+	})
+
+	t.Run("should log the progress with the default log format", func(t *testing.T) {
+		var out bytes.Buffer
+		log.SetOutput(&out)
+		log.SetFormatter(&easy.Formatter{LogFormat: "%msg%\n"})
+		defer func() {
+			log.SetOutput(os.Stderr)
+			log.SetFormatter(&log.TextFormatter{})
+		}()
+
+		files := []ExtractFile{newFile("stnet_2022-05-01.zip")}
+		reporter := NewProgressReporter(files, ProgressLog, time.Hour)
+		file := reporter.Start(files[0], 0)
+		_, _ = file.Write(content[:864])
+		reporter.logOnce()
+		file.Done(nil)
+		reporter.Stop()
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		assert.Len(t, lines, 2)
+		assert.Regexp(t, `^Downloading stnet_2022-05-01\.zip: 864 B of 1\.7 KiB \(50\.0%\), .+/s, ETA \d+`, lines[0])
+		assert.Regexp(t, `^Download progress: 864 B of 1\.7 KiB \(50\.0%\), .+/s, ETA \d+`, lines[1])
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts      int     `yaml:"max_attempts"`
+	BaseDelayMs      int     `yaml:"base_delay_ms"`
+	MaxDelayMs       int     `yaml:"max_delay_ms"`
+	Jitter           float64 `yaml:"jitter"`
+	IgnoreRetryAfter bool    `yaml:"ignore_retry_after"`
+}
+
+var DefaultIndexRetry = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelayMs: 500,
+	MaxDelayMs:  30000,
+	Jitter:      0.2,
+}
+
+var DefaultDownloadRetry = RetryPolicy{
+	MaxAttempts: 6,
+	BaseDelayMs: 1000,
+	MaxDelayMs:  60000,
+	Jitter:      0.2,
+}
+
+// WithDefaults fills in any unset values from the given defaults. Jitter and IgnoreRetryAfter are used as-is since
+// their zero values are meaningful.
+func (p *RetryPolicy) WithDefaults(defaults RetryPolicy) *RetryPolicy {
+	if p == nil {
+		return &defaults
+	}
+	policy := *p
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaults.MaxAttempts
+	}
+	if policy.BaseDelayMs <= 0 {
+		policy.BaseDelayMs = defaults.BaseDelayMs
+	}
+	if policy.MaxDelayMs <= 0 {
+		policy.MaxDelayMs = defaults.MaxDelayMs
+	}
+	if policy.MaxDelayMs < policy.BaseDelayMs {
+		policy.MaxDelayMs = policy.BaseDelayMs
+	}
+	policy.Jitter = math.Min(math.Max(policy.Jitter, 0), 1)
+	return &policy
+}
+
+func (p *RetryPolicy) BaseDelay() time.Duration {
+	return time.Duration(p.BaseDelayMs) * time.Millisecond
+}
+
+func (p *RetryPolicy) MaxDelay() time.Duration {
+	return time.Duration(p.MaxDelayMs) * time.Millisecond
+}
+
+// Backoff returns the delay before the given retry attempt (starting at 1), doubling the base delay each attempt up to
+// the max delay. Jitter randomly shortens the delay by up to that fraction so concurrent workers don't retry in lockstep.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := float64(p.BaseDelay()) * math.Pow(2, float64(max(attempt-1, 0)))
+	delay = math.Min(delay, float64(p.MaxDelay()))
+	delay -= delay * p.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// RetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func RetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if len(header) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func IsRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// Apply configures the client to retry connection errors, 429 and 5xx responses according to the policy. A Retry-After
+// header is honored even when it asks for longer than the max delay.
+func (p *RetryPolicy) Apply(client *resty.Client, name string) {
+	client.SetRetryCount(p.MaxAttempts - 1)
+	client.SetRetryWaitTime(p.BaseDelay())
+	//resty caps every delay at the max wait time, Backoff already keeps to the max delay so it's lifted to let the
+	//delay asked for in a Retry-After header through
+	client.SetRetryMaxWaitTime(time.Duration(math.MaxInt64))
+	client.AddRetryCondition(func(resp *resty.Response, err error) bool {
+		return err == nil && resp != nil && IsRetryableStatus(resp.StatusCode())
+	})
+	client.SetRetryAfter(func(_ *resty.Client, resp *resty.Response) (time.Duration, error) {
+		if !p.IgnoreRetryAfter {
+			if delay, ok := RetryAfter(resp.Header().Get("Retry-After"), time.Now()); ok {
+				return max(delay, time.Nanosecond), nil //zero tells resty to use its own backoff
+			}
+		}
+		return p.Backoff(resp.Request.Attempt), nil
+	})
+	client.AddRetryHook(func(resp *resty.Response, err error) {
+		fields := log.Fields{"client": name}
+		if resp != nil {
+			fields["status"] = resp.StatusCode()
+			fields["attempt"] = resp.Request.Attempt
+			fields["retryAfter"] = resp.Header().Get("Retry-After")
+			if resp.RawBody() != nil && resp.Request.Attempt < p.MaxAttempts {
+				//unparsed responses (file downloads) are not closed by resty, release failed attempts before retrying
+				_ = resp.RawBody().Close()
+			}
+		}
+		log.WithError(err).WithFields(fields).Debug(fmt.Sprintf("retrying request to %s", requestUrl(resp)))
+	})
+}
+
+func requestUrl(resp *resty.Response) string {
+	if resp == nil || resp.Request == nil {
+		return "unknown url"
+	}
+	return resp.Request.URL
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// s3PartSize is the size of each part of a multipart upload, which is buffered in memory while streaming a download
+const s3PartSize = 16 * 1024 * 1024
+
+var errUploadAborted = errors.New("upload aborted")
+
+// S3Storage streams files into a bucket on S3 compatible object storage such as AWS S3 or MinIO. Uploads are only
+// completed once committed, so an interrupted download never leaves a partial object behind, but it also can't be
+// resumed.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Storage connects to the configured bucket. Credentials not set in the config are taken from the standard AWS
+// environment variables and credential files.
+func NewS3Storage(c StorageConfig) (*S3Storage, error) {
+	if len(c.Bucket) == 0 {
+		return nil, fmt.Errorf("storage bucket is required for %s storage", StorageS3)
+	}
+	endpoint := c.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = "s3.amazonaws.com"
+	}
+	var creds *credentials.Credentials
+	if len(c.AccessKeyId) > 0 {
+		creds = credentials.NewStaticV4(c.AccessKeyId, c.SecretAccessKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !c.DisableSsl,
+		Region: c.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create storage client: %w", err)
+	}
+	return &S3Storage{client: client, bucket: c.Bucket, prefix: strings.Trim(c.Prefix, "/")}, nil
+}
+
+func (s *S3Storage) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *S3Storage) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(name))
+}
+
+func (s *S3Storage) Exists(name string) (bool, error) {
+	_, err := s.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3Storage) Stat(name string) (*StorageInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", s.Location(name), os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return &StorageInfo{Size: info.Size, Modified: info.LastModified}, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+// Writer streams the written data into a multipart upload, which is completed on commit and abandoned otherwise
+func (s *S3Storage) Writer(name string) (StorageWriter, error) {
+	reader, writer := io.Pipe()
+	w := &s3Writer{PipeWriter: writer, done: make(chan error, 1)}
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), reader, -1, minio.PutObjectOptions{
+			PartSize: s3PartSize,
+		})
+		//unblock any pending writes if the upload fails
+		_ = reader.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type s3Writer struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Commit() error {
+	_ = w.PipeWriter.Close()
+	return <-w.done
+}
+
+func (w *s3Writer) Abort() error {
+	_ = w.PipeWriter.CloseWithError(errUploadAborted)
+	err := <-w.done
+	if errors.Is(err, errUploadAborted) {
+		return nil
+	}
+	return err
+}
+
+func (w *s3Writer) Close() error {
+	return w.Abort()
+}
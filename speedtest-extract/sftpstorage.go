@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSftpPort = 22
+
+// SftpStorage writes files to a directory on an SFTP server, such as a drop zone. As with local storage, files are
+// written to a temp file next to the destination and renamed once committed, and interrupted writes can be resumed.
+type SftpStorage struct {
+	client    *sftp.Client
+	conn      *ssh.Client
+	directory string
+	location  string
+}
+
+// sshAuth reads the private key used to log in to the SFTP server
+func sshAuth(c StorageConfig) (ssh.AuthMethod, error) {
+	if len(c.PrivateKeyFile) == 0 {
+		return nil, fmt.Errorf("storage private_key_file is required for %s storage", StorageSftp)
+	}
+	key, err := os.ReadFile(expandHome(c.PrivateKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %w", err)
+	}
+	var signer ssh.Signer
+	if len(c.PrivateKeyPassphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(c.PrivateKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key %s: %w", c.PrivateKeyFile, err)
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// sshHostKeyCallback checks the server against the known hosts file, which defaults to ~/.ssh/known_hosts
+func sshHostKeyCallback(c StorageConfig) (ssh.HostKeyCallback, error) {
+	if c.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	knownHostsFile := c.KnownHostsFile
+	if len(knownHostsFile) == 0 {
+		knownHostsFile = "~/.ssh/known_hosts"
+	}
+	callback, err := knownhosts.New(expandHome(knownHostsFile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(fileName string) string {
+	if fileName == "~" || strings.HasPrefix(fileName, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, fileName[1:])
+		}
+	}
+	return fileName
+}
+
+// NewSftpStorage connects to the configured SFTP server using key based authentication
+func NewSftpStorage(c StorageConfig) (*SftpStorage, error) {
+	if len(c.Host) == 0 || len(c.User) == 0 {
+		return nil, fmt.Errorf("storage host and user are required for %s storage", StorageSftp)
+	}
+	auth, err := sshAuth(c)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := sshHostKeyCallback(c)
+	if err != nil {
+		return nil, err
+	}
+	port := c.Port
+	if port == 0 {
+		port = defaultSftpPort
+	}
+	address := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            c.User,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", address, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to start sftp session on %s: %w", address, err)
+	}
+	directory := c.Directory
+	if len(directory) == 0 {
+		directory = "."
+	}
+	return &SftpStorage{
+		client:    client,
+		conn:      conn,
+		directory: directory,
+		location:  fmt.Sprintf("sftp://%s@%s", c.User, address),
+	}, nil
+}
+
+func (s *SftpStorage) Close() error {
+	err := s.client.Close()
+	if connErr := s.conn.Close(); err == nil {
+		err = connErr
+	}
+	return err
+}
+
+func (s *SftpStorage) path(name string) string {
+	return path.Join(s.directory, name)
+}
+
+func (s *SftpStorage) Location(name string) string {
+	remotePath := s.path(name)
+	if !path.IsAbs(remotePath) {
+		remotePath = "/~/" + remotePath
+	}
+	return s.location + remotePath
+}
+
+func (s *SftpStorage) Exists(name string) (bool, error) {
+	_, err := s.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SftpStorage) Stat(name string) (*StorageInfo, error) {
+	stats, err := s.client.Stat(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &StorageInfo{Size: stats.Size(), Modified: stats.ModTime()}, nil
+}
+
+func (s *SftpStorage) Delete(name string) error {
+	return s.client.Remove(s.path(name))
+}
+
+func (s *SftpStorage) Writer(name string) (StorageWriter, error) {
+	return s.open(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+}
+
+func (s *SftpStorage) Resume(name string) (StorageWriter, error) {
+	return s.open(name, os.O_WRONLY|os.O_APPEND)
+}
+
+func (s *SftpStorage) Partial(name string) (io.ReadCloser, int64, error) {
+	f, err := s.client.Open(s.path(name) + PartialFileSuffix)
+	if err != nil {
+		return nil, 0, err
+	}
+	stats, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, stats.Size(), nil
+}
+
+func (s *SftpStorage) open(name string, flags int) (StorageWriter, error) {
+	remotePath := s.path(name)
+	err := s.client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s: %w", path.Dir(remotePath), err)
+	}
+	f, err := s.client.OpenFile(remotePath+PartialFileSuffix, flags)
+	if err != nil {
+		return nil, err
+	}
+	if flags&os.O_APPEND != 0 {
+		//sftp writes at the file's offset, which starts at zero even when appending
+		_, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return &sftpWriter{File: f, client: s.client, remotePath: remotePath}, nil
+}
+
+type sftpWriter struct {
+	*sftp.File
+	client     *sftp.Client
+	remotePath string
+}
+
+func (w *sftpWriter) Commit() error {
+	err := w.File.Close()
+	if err != nil {
+		return err
+	}
+	//posix-rename replaces an existing file, which a plain sftp rename refuses to do
+	err = w.client.PosixRename(w.File.Name(), w.remotePath)
+	if err != nil {
+		_ = w.client.Remove(w.remotePath)
+		err = w.client.Rename(w.File.Name(), w.remotePath)
+	}
+	return err
+}
+
+func (w *sftpWriter) Abort() error {
+	_ = w.File.Close()
+	return w.client.Remove(w.File.Name())
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startSftpServer runs an SSH server that only accepts the given client key and serves sftp from dir
+func startSftpServer(t *testing.T, dir string, clientKey ssh.PublicKey) (net.Listener, ssh.PublicKey) {
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	assert.Nil(t, err)
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "drop" && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSftp(conn, serverConfig, dir)
+		}
+	}()
+	return listener, hostSigner.PublicKey()
+}
+
+func serveSftp(conn net.Conn, serverConfig *ssh.ServerConfig, dir string) {
+	_, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(dir))
+					if err == nil {
+						_ = server.Serve()
+					}
+					_ = channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSftpStorage(t *testing.T) {
+	clientPublic, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	clientKey, err := ssh.NewPublicKey(clientPublic)
+	assert.Nil(t, err)
+	keyDir := t.TempDir()
+	block, err := ssh.MarshalPrivateKey(clientPrivate, "")
+	assert.Nil(t, err)
+	keyFile := filepath.Join(keyDir, "id_ed25519")
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+
+	remoteDir := t.TempDir()
+	listener, hostKey := startSftpServer(t, remoteDir, clientKey)
+	defer listener.Close()
+	host, portValue, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portValue)
+	knownHostsFile := filepath.Join(keyDir, "known_hosts")
+	assert.Nil(t, os.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{listener.Addr().String()}, hostKey)+"\n"), 0600))
+
+	storageConfig := StorageConfig{
+		Type:           StorageSftp,
+		Host:           host,
+		Port:           port,
+		User:           "drop",
+		PrivateKeyFile: keyFile,
+		KnownHostsFile: knownHostsFile,
+		Directory:      "incoming",
+	}
+
+	t.Run("should reject unknown hosts", func(t *testing.T) {
+		emptyKnownHosts := filepath.Join(keyDir, "empty_known_hosts")
+		assert.Nil(t, os.WriteFile(emptyKnownHosts, nil, 0600))
+		c := storageConfig
+		c.KnownHostsFile = emptyKnownHosts
+		_, err := NewStorage(Config{Storage: &c})
+		assert.NotNil(t, err)
+	})
+
+	storage, err := NewStorage(Config{Storage: &storageConfig})
+	assert.Nil(t, err)
+	defer storage.(*SftpStorage).Close()
+
+	t.Run("should only store committed files", func(t *testing.T) {
+		w, err := storage.Writer("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		_, _ = w.Write([]byte("hel"))
+		assert.Nil(t, w.Close())
+		exists, err := storage.Exists("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		resumable := storage.(ResumableStorage)
+		_, size, err := resumable.Partial("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3), size)
+		w, err = resumable.Resume("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		_, _ = w.Write([]byte("lo"))
+		assert.Nil(t, w.Commit())
+
+		contents, _ := os.ReadFile(filepath.Join(remoteDir, "incoming", "native", "stnet", "stnet_2022-05-01.zip"))
+		assert.Equal(t, "hello", string(contents))
+		info, err := storage.Stat("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(5), info.Size)
+
+		assert.Nil(t, storage.Delete("native/stnet/stnet_2022-05-01.zip"))
+		_, err = storage.Stat("native/stnet/stnet_2022-05-01.zip")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("should download into the drop zone", func(t *testing.T) {
+		content := bytes.Repeat([]byte("speedtest"), 1000)
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			requests += 1
+			http.ServeContent(res, req, "stnet_2022-05-01.zip", time.Time{}, bytes.NewReader(content))
+		}))
+		defer server.Close()
+
+		file := ExtractFile{
+			Dataset: "stnet",
+			Name:    "stnet_2022-05-01.zip",
+			Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL, Type: "file", Size: int64(len(content)), Groups: []string{"native"}},
+		}
+		result := file.Download(resty.New(), DownloadOptions{UseFileHierarchy: true, Storage: storage})
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		contents, _ := os.ReadFile(filepath.Join(remoteDir, "incoming", "native", "stnet", "stnet_2022-05-01.zip"))
+		assert.Equal(t, content, contents)
+		assert.NoFileExists(t, filepath.Join(remoteDir, "incoming", "native", "stnet", "stnet_2022-05-01.zip"+PartialFileSuffix))
+
+		result = file.Download(resty.New(), DownloadOptions{UseFileHierarchy: true, Storage: storage})
+		assert.Nil(t, result.err)
+		assert.False(t, result.success)
+		assert.Equal(t, 1, requests)
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const StateVersion = 1
+
+const (
+	StatusNew       = "new"
+	StatusChanged   = "changed"
+	StatusCurrent   = "current"
+	StatusUntracked = "untracked"
+)
+
+// StateEntry records a file as it was on the server when it was last downloaded
+type StateEntry struct {
+	Key          string    `json:"key"`
+	Url          string    `json:"url"`
+	Size         int64     `json:"size"`
+	Modified     int64     `json:"mtime"`
+	Checksum     string    `json:"checksum,omitempty"`
+	LocalPath    string    `json:"local_path"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+// DownloadState is the persistent record of downloaded files, used to fetch only new or changed files regardless of
+// what has happened to the local copies since
+type DownloadState struct {
+	Version int                    `json:"version"`
+	Files   map[string]*StateEntry `json:"files"`
+
+	filename string
+	mu       sync.Mutex
+}
+
+// StateKey identifies a file by its location in the extract hierarchy. Download urls may be signed and change between
+// requests, so they can't be used to match files across runs.
+func (e *ExtractFile) StateKey() string {
+	return strings.Join(append(append([]string{}, e.Item.Groups...), e.Name), "/")
+}
+
+// Matches reports whether the file on the server is unchanged since the entry was recorded
+func (s *StateEntry) Matches(item *ExtractItem) bool {
+	return s.Size == item.Size && s.Modified == item.Modified
+}
+
+// LoadState reads the state file, starting an empty state if it doesn't exist yet
+func LoadState(filename string) (*DownloadState, error) {
+	state := &DownloadState{
+		Version:  StateVersion,
+		Files:    make(map[string]*StateEntry),
+		filename: filename,
+	}
+	contents, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*StateEntry)
+	}
+	return state, nil
+}
+
+func (s *DownloadState) Get(file ExtractFile) *StateEntry {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Files[file.StateKey()]
+}
+
+// Record stores the downloaded file and saves the state, so progress isn't lost if a later download fails
+func (s *DownloadState) Record(file ExtractFile, localPath string, checksum *Checksum) error {
+	if s == nil {
+		return nil
+	}
+	entry := &StateEntry{
+		Key:          file.StateKey(),
+		Url:          file.Item.Url,
+		Size:         file.Item.Size,
+		Modified:     file.Item.Modified,
+		LocalPath:    localPath,
+		DownloadedAt: time.Now().UTC(),
+	}
+	if checksum != nil {
+		entry.Checksum = checksum.String()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[entry.Key] = entry
+	return s.save()
+}
+
+// save writes the state to a temp file and renames it into place so an interrupted write can't corrupt it
+func (s *DownloadState) save() error {
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.filename)
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(out)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
+
+// Status compares the file on the server to the recorded state. Files that exist in storage but were never recorded,
+// such as ones downloaded before the state file existed, are reported as untracked.
+func (s *DownloadState) Status(file ExtractFile, storage Storage, useFileHierarchy bool) (string, *StateEntry) {
+	entry := s.Get(file)
+	if entry == nil {
+		if name, err := file.StoragePath(useFileHierarchy); err == nil {
+			if exists, _ := storage.Exists(name); exists {
+				return StatusUntracked, nil
+			}
+		}
+		return StatusNew, nil
+	}
+	if !entry.Matches(file.Item) {
+		return StatusChanged, entry
+	}
+	return StatusCurrent, entry
+}
+
+func ListStatus(files []ExtractFile, state *DownloadState, storage Storage, useFileHierarchy bool) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Groups", "Dataset", "File", "Status", "Downloaded", "Local Path"})
+	t.SetColumnConfigs([]table.ColumnConfig{
+		{Number: 1, AutoMerge: true},
+		{Number: 2, AutoMerge: true},
+	})
+	for _, f := range files {
+		status, entry := state.Status(f, storage, useFileHierarchy)
+		downloaded, localPath := "", ""
+		if entry != nil {
+			downloaded = entry.DownloadedAt.Format(time.RFC3339)
+			localPath = entry.LocalPath
+			if name, err := f.StoragePath(useFileHierarchy); err != nil {
+				localPath += fmt.Sprintf(" (%s)", err)
+			} else if exists, _ := storage.Exists(name); !exists {
+				localPath += " (missing)"
+			}
+		}
+		groups := strings.Join(f.Item.Groups, ", ")
+		t.AppendRow(table.Row{groups, f.Dataset, f.Name, status, downloaded, localPath})
+	}
+	t.Render()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+	StorageSftp  = "sftp"
+)
+
+var StorageTypes = []string{StorageLocal, StorageS3, StorageSftp}
+
+// StorageConfig selects where downloaded files are stored. Local storage uses storage_directory, the other fields
+// configure S3 compatible object storage or an SFTP server.
+type StorageConfig struct {
+	Type string `yaml:"type"`
+
+	Endpoint        string `yaml:"endpoint,omitempty"`
+	Region          string `yaml:"region,omitempty"`
+	Bucket          string `yaml:"bucket,omitempty"`
+	Prefix          string `yaml:"prefix,omitempty"`
+	AccessKeyId     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+	DisableSsl      bool   `yaml:"disable_ssl,omitempty"`
+
+	Host                  string `yaml:"host,omitempty"`
+	Port                  int    `yaml:"port,omitempty"`
+	User                  string `yaml:"user,omitempty"`
+	PrivateKeyFile        string `yaml:"private_key_file,omitempty"`
+	PrivateKeyPassphrase  string `yaml:"private_key_passphrase,omitempty"`
+	KnownHostsFile        string `yaml:"known_hosts_file,omitempty"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key,omitempty"`
+	Directory             string `yaml:"directory,omitempty"`
+}
+
+// StorageInfo describes a stored file
+type StorageInfo struct {
+	Size     int64
+	Modified time.Time
+}
+
+// Storage is where downloaded files are written. Names are slash separated paths relative to the root of the storage.
+type Storage interface {
+	// Exists reports whether a complete file is stored under name
+	Exists(name string) (bool, error)
+	// Stat describes the file stored under name, returning an error matching os.ErrNotExist if there isn't one
+	Stat(name string) (*StorageInfo, error)
+	// Writer starts writing a file, which only appears under name once committed
+	Writer(name string) (StorageWriter, error)
+	Delete(name string) error
+	// Location describes where name is stored for log messages and the state file
+	Location(name string) string
+}
+
+// StorageWriter writes a file to storage. Exactly one of Commit, Abort or Close should be called once writing is
+// finished.
+type StorageWriter interface {
+	io.Writer
+	// Commit stores the written data under the file name
+	Commit() error
+	// Abort discards the written data
+	Abort() error
+	// Close stops writing without storing the data under the file name. ResumableStorage keeps the data written so far
+	// so it can be resumed, other storage discards it.
+	Close() error
+}
+
+// ResumableStorage keeps the data from an interrupted write, so a download can continue where it stopped rather than
+// starting over
+type ResumableStorage interface {
+	Storage
+	// Partial opens the data kept from an interrupted write to name, returning its size
+	Partial(name string) (io.ReadCloser, int64, error)
+	// Resume continues an interrupted write to name, appending to the data kept so far
+	Resume(name string) (StorageWriter, error)
+}
+
+// IsLocalStorage reports whether files are stored in the storage directory rather than remote storage
+func IsLocalStorage(c Config) bool {
+	return c.Storage == nil || len(c.Storage.Type) == 0 || c.Storage.Type == StorageLocal
+}
+
+// NewStorage creates the storage configured in the config file, defaulting to the storage directory
+func NewStorage(c Config) (Storage, error) {
+	if IsLocalStorage(c) {
+		return &LocalStorage{Root: c.StorageDirectory}, nil
+	} else if c.Storage.Type == StorageS3 {
+		return NewS3Storage(*c.Storage)
+	} else if c.Storage.Type == StorageSftp {
+		return NewSftpStorage(*c.Storage)
+	}
+	return nil, fmt.Errorf("unknown storage type %q, expected one of %s", c.Storage.Type, strings.Join(StorageTypes, ", "))
+}
+
+// LocalStorage stores files in a directory on the local filesystem. Files are written to a temp file next to the
+// destination and renamed once committed, so a partial file is never mistaken for a finished one.
+type LocalStorage struct {
+	Root string
+}
+
+func (s *LocalStorage) Path(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(name))
+}
+
+func (s *LocalStorage) Location(name string) string {
+	return s.Path(name)
+}
+
+func (s *LocalStorage) Exists(name string) (bool, error) {
+	_, err := os.Stat(s.Path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStorage) Stat(name string) (*StorageInfo, error) {
+	stats, err := os.Stat(s.Path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &StorageInfo{Size: stats.Size(), Modified: stats.ModTime()}, nil
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	return os.Remove(s.Path(name))
+}
+
+func (s *LocalStorage) Writer(name string) (StorageWriter, error) {
+	return s.open(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+}
+
+func (s *LocalStorage) Resume(name string) (StorageWriter, error) {
+	return s.open(name, os.O_WRONLY|os.O_APPEND)
+}
+
+func (s *LocalStorage) Partial(name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(s.Path(name) + PartialFileSuffix)
+	if err != nil {
+		return nil, 0, err
+	}
+	stats, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, stats.Size(), nil
+}
+
+func (s *LocalStorage) open(name string, flags int) (StorageWriter, error) {
+	err := makeDirs(s.Root, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	fileName := s.Path(name)
+	f, err := os.OpenFile(fileName+PartialFileSuffix, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: f, fileName: fileName}, nil
+}
+
+type localWriter struct {
+	*os.File
+	fileName string
+}
+
+func (w *localWriter) Commit() error {
+	err := w.File.Sync()
+	if closeErr := w.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(w.File.Name(), w.fileName)
+}
+
+func (w *localWriter) Abort() error {
+	_ = w.File.Close()
+	return os.Remove(w.File.Name())
+}
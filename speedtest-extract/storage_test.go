@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/go-resty/resty/v2"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStorage(t *testing.T) {
+	storage := &LocalStorage{Root: filepath.Join(t.TempDir(), "extracts")}
+
+	t.Run("should only store committed files", func(t *testing.T) {
+		w, err := storage.Writer("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		_, _ = w.Write([]byte("hello"))
+		exists, err := storage.Exists("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		assert.Nil(t, w.Commit())
+		info, err := storage.Stat("native/stnet/stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(5), info.Size)
+		assert.Equal(t, filepath.Join(storage.Root, "native", "stnet", "stnet_2022-05-01.zip"), storage.Location("native/stnet/stnet_2022-05-01.zip"))
+	})
+
+	t.Run("should keep closed writes for resuming", func(t *testing.T) {
+		w, _ := storage.Writer("stnet_2022-06-01.zip")
+		_, _ = w.Write([]byte("hel"))
+		assert.Nil(t, w.Close())
+		partial, size, err := storage.Partial("stnet_2022-06-01.zip")
+		assert.Nil(t, err)
+		_ = partial.Close()
+		assert.Equal(t, int64(3), size)
+
+		w, err = storage.Resume("stnet_2022-06-01.zip")
+		assert.Nil(t, err)
+		_, _ = w.Write([]byte("lo"))
+		assert.Nil(t, w.Commit())
+		contents, _ := os.ReadFile(storage.Path("stnet_2022-06-01.zip"))
+		assert.Equal(t, "hello", string(contents))
+	})
+
+	t.Run("should discard aborted writes", func(t *testing.T) {
+		w, _ := storage.Writer("stnet_2022-07-01.zip")
+		_, _ = w.Write([]byte("hello"))
+		assert.Nil(t, w.Abort())
+		_, _, err := storage.Partial("stnet_2022-07-01.zip")
+		assert.True(t, os.IsNotExist(err))
+		_, err = storage.Stat("stnet_2022-07-01.zip")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("should delete files", func(t *testing.T) {
+		assert.Nil(t, storage.Delete("native/stnet/stnet_2022-05-01.zip"))
+		exists, _ := storage.Exists("native/stnet/stnet_2022-05-01.zip")
+		assert.False(t, exists)
+	})
+}
+
+func TestS3Storage(t *testing.T) {
+	backend := s3mem.New()
+	s3Server := httptest.NewTLSServer(gofakes3.New(backend).Server())
+	defer s3Server.Close()
+	assert.Nil(t, backend.CreateBucket("extracts"))
+
+	storage, err := NewStorage(Config{Storage: &StorageConfig{
+		Type:            StorageS3,
+		Endpoint:        strings.TrimPrefix(s3Server.URL, "https://"),
+		Region:          "us-east-1",
+		Bucket:          "extracts",
+		Prefix:          "/speedtest/",
+		AccessKeyId:     "access",
+		SecretAccessKey: "secret",
+	}})
+	assert.Nil(t, err)
+	s3 := storage.(*S3Storage)
+	//the fake server doesn't understand the chunked uploads used over plain http, so trust its certificate instead
+	s3.client, err = minio.New(s3.client.EndpointURL().Host, &minio.Options{
+		Creds:     credentials.NewStaticV4("access", "secret", ""),
+		Secure:    true,
+		Region:    "us-east-1",
+		Transport: s3Server.Client().Transport,
+	})
+	assert.Nil(t, err)
+	getObject := func(key string) string {
+		obj, err := s3.client.GetObject(context.Background(), "extracts", key, minio.GetObjectOptions{})
+		assert.Nil(t, err)
+		defer obj.Close()
+		contents, _ := io.ReadAll(obj)
+		return string(contents)
+	}
+
+	t.Run("should only store committed files", func(t *testing.T) {
+		w, err := storage.Writer("stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		_, _ = w.Write([]byte("hello"))
+		assert.Nil(t, w.Abort())
+		exists, err := storage.Exists("stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		assert.False(t, exists)
+		_, err = storage.Stat("stnet_2022-05-01.zip")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		w, _ = storage.Writer("stnet_2022-05-01.zip")
+		_, _ = w.Write([]byte("hello"))
+		assert.Nil(t, w.Commit())
+		info, err := storage.Stat("stnet_2022-05-01.zip")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(5), info.Size)
+		assert.Equal(t, "hello", getObject("speedtest/stnet_2022-05-01.zip"))
+		assert.Equal(t, "s3://extracts/speedtest/stnet_2022-05-01.zip", storage.Location("stnet_2022-05-01.zip"))
+
+		assert.Nil(t, storage.Delete("stnet_2022-05-01.zip"))
+		exists, _ = storage.Exists("stnet_2022-05-01.zip")
+		assert.False(t, exists)
+	})
+
+	t.Run("should stream downloads into the bucket", func(t *testing.T) {
+		content := bytes.Repeat([]byte("speedtest"), 1000)
+		digest := md5.Sum(content)
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("ETag", `"`+hex.EncodeToString(digest[:])+`"`)
+			http.ServeContent(res, req, "stnet_2022-05-01.zip", time.Time{}, bytes.NewReader(content))
+		}))
+		defer server.Close()
+
+		state, _ := LoadState(filepath.Join(t.TempDir(), ".extracts-state.json"))
+		file := ExtractFile{
+			Dataset: "stnet",
+			Name:    "stnet_2022-05-01.zip",
+			Item:    &ExtractItem{Name: "stnet_2022-05-01.zip", Url: server.URL, Type: "file", Size: int64(len(content)), Groups: []string{"native"}},
+		}
+		result := file.Download(resty.New(), DownloadOptions{UseFileHierarchy: true, State: state, Storage: storage})
+		assert.Nil(t, result.err)
+		assert.True(t, result.success)
+		assert.Equal(t, string(content), getObject("speedtest/native/stnet/stnet_2022-05-01.zip"))
+		assert.Equal(t, "s3://extracts/speedtest/native/stnet/stnet_2022-05-01.zip", state.Get(file).LocalPath)
+
+		status, _ := state.Status(file, storage, true)
+		assert.Equal(t, StatusCurrent, status)
+		result = file.Download(resty.New(), DownloadOptions{UseFileHierarchy: true, State: state, Storage: storage})
+		assert.Nil(t, result.err)
+		assert.False(t, result.success)
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	SyncAdd    = "add"
+	SyncUpdate = "update"
+	SyncDelete = "delete"
+)
+
+type SyncOptions struct {
+	Prune       bool
+	TrashDir    string
+	DryRun      bool
+	Concurrency int
+	Progress    string
+	Limiter     *BandwidthLimiter
+	Storage     Storage
+	//Filter is the filter the files were selected with, which limits what is pruned
+	Filter FileFilter
+}
+
+type SyncAction struct {
+	Action string
+	Path   string
+	File   *ExtractFile
+}
+
+// PlanSync works out which files need to be added or updated for the storage to mirror the given files, and when
+// pruning, which local files are no longer part of it
+func PlanSync(files []ExtractFile, state *DownloadState, options SyncOptions) ([]SyncAction, error) {
+	storage := options.Storage
+	if storage == nil {
+		storage = &LocalStorage{Root: config.StorageDirectory}
+	}
+	if _, local := storage.(*LocalStorage); options.Prune && !local {
+		return nil, fmt.Errorf("--prune is only supported with local storage")
+	}
+	actions := make([]SyncAction, 0)
+	expected := make(map[string]bool, len(files))
+	for i, f := range files {
+		name, err := f.StoragePath(true)
+		if err != nil {
+			return nil, err
+		}
+		localPath := storage.Location(name)
+		expected[filepath.Clean(localPath)] = true
+		action := ""
+		stats, err := storage.Stat(name)
+		if err != nil {
+			action = SyncAdd
+		} else {
+			status, _ := state.Status(f, storage, true)
+			if status == StatusChanged || (status == StatusUntracked && stats.Size != f.Item.Size) {
+				action = SyncUpdate
+			}
+		}
+		if len(action) > 0 {
+			actions = append(actions, SyncAction{Action: action, Path: localPath, File: &files[i]})
+		}
+	}
+
+	if options.Prune {
+		stale, err := findStaleFiles(expected, options.Filter, options.TrashDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range stale {
+			actions = append(actions, SyncAction{Action: SyncDelete, Path: path})
+		}
+	}
+	return actions, nil
+}
+
+// findStaleFiles looks for extract archives in the storage directory that aren't expected and fall within the filter,
+// so pruning with a filter only touches the groups and datasets being synced while an unfiltered sync prunes anything
+// that dropped out of the index. Only zip and gzip files are considered, leaving the files unpacked by --extract and
+// written by convert, and anything else kept alongside the extracts, alone. Hidden files, the config file, the trash
+// directory and partial downloads of expected files are also left alone.
+func findStaleFiles(expected map[string]bool, filter FileFilter, trashDir string) ([]string, error) {
+	root := filepath.Clean(config.StorageDirectory)
+	ignored := make(map[string]bool)
+	for _, path := range []string{trashDir, configPath} {
+		if len(path) > 0 {
+			if abs, err := filepath.Abs(path); err == nil {
+				ignored[abs] = true
+			}
+		}
+	}
+	expectedDirs := make(map[string]bool)
+	for path := range expected {
+		expectedDirs[filepath.Dir(path)] = true
+	}
+
+	stale := make([]string, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		abs, _ := filepath.Abs(path)
+		if path != root && (strings.HasPrefix(d.Name(), ".") || ignored[abs]) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := strings.TrimSuffix(path, PartialFileSuffix)
+		if !IsArchive(name) || expected[name] {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if inPruneScope(filepath.ToSlash(rel), filter, expectedDirs[filepath.Dir(path)]) {
+			stale = append(stale, path)
+		}
+		return nil
+	})
+	return stale, err
+}
+
+// inPruneScope reports whether the file at the slash separated path relative to the storage directory falls within
+// the filter. The groups and dataset are read back from the file hierarchy, so files that aren't at least two
+// directories deep are never in scope. With a path template the dataset is taken from the file name instead, and as
+// the groups can't be recovered a group filter limits pruning to the directories that hold synced files.
+func inPruneScope(rel string, filter FileFilter, syncedDir bool) bool {
+	parts := strings.Split(rel, "/")
+	name, dirs := parts[len(parts)-1], parts[:len(parts)-1]
+	if !filter.Filenames.MatchOrEmpty(name) || filter.ExcludeFilenames.Match(name) {
+		return false
+	}
+	var dataset string
+	if pathTemplate != nil {
+		if len(dirs) == 0 || ((len(filter.Groups) > 0 || len(filter.ExcludeGroups) > 0) && !syncedDir) {
+			return false
+		}
+		dataset = (&ExtractItem{Name: name}).DatasetName()
+	} else {
+		if len(dirs) < 2 || !filter.matchesGroups(dirs[:len(dirs)-1]) {
+			return false
+		}
+		dataset = dirs[len(dirs)-1]
+	}
+	return filter.Datasets.MatchOrEmpty(dataset) && !filter.ExcludeDatasets.Match(dataset)
+}
+
+// pruneFile deletes the file, or moves it into the trash directory keeping its path relative to the storage
+// directory, then removes any directories left empty
+func pruneFile(path string, trashDir string) error {
+	root := filepath.Clean(config.StorageDirectory)
+	if len(trashDir) > 0 {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(trashDir, rel)
+		err = makeDirPath(filepath.Dir(dest))
+		if err != nil {
+			return err
+		}
+		err = os.Rename(path, dest)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			break
+		}
+		if os.Remove(dir) != nil { //fails when the directory isn't empty
+			break
+		}
+	}
+	return nil
+}
+
+func ListSyncActions(actions []SyncAction) {
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].Path < actions[j].Path
+	})
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Action", "Path"})
+	for _, a := range actions {
+		t.AppendRow(table.Row{a.Action, a.Path})
+	}
+	t.Render()
+}
+
+// SyncFiles mirrors the given files into the storage directory using the file hierarchy, downloading files that are
+// missing or changed and optionally pruning local files that are no longer available
+func SyncFiles(files []ExtractFile, options SyncOptions) error {
+	state, err := LoadState(config.StateFilename)
+	if err != nil {
+		return fmt.Errorf("unable to read download state from %s: %w", config.StateFilename, err)
+	}
+	actions, err := PlanSync(files, state, options)
+	if err != nil {
+		return err
+	}
+
+	adds, updates := make([]ExtractFile, 0), make([]ExtractFile, 0)
+	deletes := make([]string, 0)
+	for _, a := range actions {
+		switch a.Action {
+		case SyncAdd:
+			adds = append(adds, *a.File)
+		case SyncUpdate:
+			updates = append(updates, *a.File)
+		case SyncDelete:
+			deletes = append(deletes, a.Path)
+		}
+	}
+	log.Info(fmt.Sprintf("%d file(s) to add, %d to update, %d to delete", len(adds), len(updates), len(deletes)))
+	if options.DryRun {
+		if len(actions) > 0 {
+			ListSyncActions(actions)
+		}
+		return nil
+	}
+
+	added, updated, deleted, errorCount := 0, 0, 0, 0
+	downloadOptions := DownloadOptions{UseFileHierarchy: true, State: state, Mirror: true, Limiter: options.Limiter, Storage: options.Storage}
+	if len(adds) > 0 {
+		downloaded, _, errs := DownloadFiles(adds, downloadOptions, options.Concurrency, options.Progress)
+		added += downloaded
+		errorCount += errs
+	}
+	if len(updates) > 0 {
+		downloadOptions.OverwriteExisting = true
+		downloaded, _, errs := DownloadFiles(updates, downloadOptions, options.Concurrency, options.Progress)
+		updated += downloaded
+		errorCount += errs
+	}
+	for _, path := range deletes {
+		if len(options.TrashDir) > 0 {
+			log.Info(fmt.Sprintf("Moving %s to %s", path, options.TrashDir))
+		} else {
+			log.Info(fmt.Sprintf("Deleting %s", path))
+		}
+		err = pruneFile(path, options.TrashDir)
+		if err != nil {
+			log.WithError(err).Error(fmt.Sprintf("error pruning %s", path))
+			errorCount += 1
+		} else {
+			deleted += 1
+		}
+	}
+	log.Info(fmt.Sprintf("Added %d file(s), updated %d, deleted %d, encountered %d error(s)", added, updated, deleted, errorCount))
+	if errorCount > 0 {
+		return fmt.Errorf("sync completed with %d error(s)", errorCount)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	extracts, _ := GetTestExtracts()
+	//the fixtures repeat file names within a group, keep one of each so every file has its own path
+	files := make([]ExtractFile, 0)
+	seen := make(map[string]bool)
+	filter := FileFilter{Groups: []string{"android"}}
+	for _, f := range FilterFiles(extracts, filter, nil) {
+		if !seen[f.Name] {
+			seen[f.Name] = true
+			files = append(files, f)
+		}
+	}
+	config.StorageDirectory = t.TempDir()
+	state, _ := LoadState(filepath.Join(t.TempDir(), ".extracts-state.json"))
+
+	write := func(path string, size int64) {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0700))
+		assert.Nil(t, os.WriteFile(path, make([]byte, size), 0644))
+	}
+	write(localPath(t, files[0], true), files[0].Item.Size)
+	write(localPath(t, files[1], true), files[1].Item.Size+1)
+	stale := filepath.Join(config.StorageDirectory, "android", "android", "android_2021-01-01.zip")
+	write(stale, 10)
+	write(filepath.Join(config.StorageDirectory, "notes.txt"), 10)
+	write(filepath.Join(config.StorageDirectory, "android", ".hidden"), 10)
+	//files outside of the synced groups, and ones derived from the downloads, are never pruned
+	kept := []string{
+		filepath.Join(config.StorageDirectory, "web", "stnet", "stnet_2021-01-01.zip"),
+		filepath.Join(config.StorageDirectory, "notes", "archive.zip"),
+		ConvertedPath(localPath(t, files[0], true), ConvertParquet),
+		filepath.Join(filepath.Dir(localPath(t, files[0], true)), "android_2021-01-01.csv"),
+	}
+	for _, path := range kept {
+		write(path, 10)
+	}
+
+	t.Run("should plan adds and updates", func(t *testing.T) {
+		actions, err := PlanSync(files, state, SyncOptions{})
+		assert.Nil(t, err)
+		counts := make(map[string]int)
+		for _, a := range actions {
+			counts[a.Action] += 1
+		}
+		assert.Equal(t, map[string]int{SyncAdd: len(files) - 2, SyncUpdate: 1}, counts)
+	})
+
+	deletes := func(options SyncOptions) []string {
+		options.Prune = true
+		actions, err := PlanSync(files, state, options)
+		assert.Nil(t, err)
+		paths := make([]string, 0)
+		for _, a := range actions {
+			if a.Action == SyncDelete {
+				paths = append(paths, a.Path)
+			}
+		}
+		return paths
+	}
+
+	t.Run("should only prune files in the hierarchy", func(t *testing.T) {
+		assert.Equal(t, []string{stale}, deletes(SyncOptions{Filter: filter}))
+	})
+
+	t.Run("should move pruned files to the trash directory", func(t *testing.T) {
+		trash := t.TempDir()
+		assert.Nil(t, pruneFile(stale, trash))
+		assert.FileExists(t, filepath.Join(trash, "android", "android", "android_2021-01-01.zip"))
+		assert.NoFileExists(t, stale)
+	})
+
+	t.Run("should keep the files of other groups when syncing with a group filter", func(t *testing.T) {
+		write(stale, 10)
+		for _, path := range deletes(SyncOptions{Filter: filter}) {
+			assert.Nil(t, pruneFile(path, ""))
+		}
+		assert.NoFileExists(t, stale)
+		for _, path := range kept {
+			assert.FileExists(t, path)
+		}
+	})
+
+	t.Run("should prune datasets that are no longer in the index", func(t *testing.T) {
+		retired := filepath.Join(config.StorageDirectory, "android", "retired", "retired_2021-01-01.zip")
+		write(retired, 10)
+		assert.Equal(t, []string{retired}, deletes(SyncOptions{Filter: filter}))
+		assert.Empty(t, deletes(SyncOptions{Filter: FileFilter{Groups: []string{"android"}, Datasets: []string{"android"}}}))
+	})
+
+	t.Run("should prune every group and dataset without a filter", func(t *testing.T) {
+		retired := filepath.Join(config.StorageDirectory, "android", "retired", "retired_2021-01-01.zip")
+		assert.ElementsMatch(t, []string{retired, kept[0]}, deletes(SyncOptions{}))
+	})
+}
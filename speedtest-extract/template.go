@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateFuncs are the helper functions available to list templates
+var TemplateFuncs = template.FuncMap{
+	"size": HumanSize,
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"join": func(sep string, items []string) string {
+		return strings.Join(items, sep)
+	},
+}
+
+// templateEscapes is applied in a single pass so an escaped backslash is never read again as the start of \t or \n
+var templateEscapes = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n")
+
+// ParseListTemplate parses a template given on the command line or read from a file. Escape sequences such as \t and
+// \n are interpreted for templates given on the command line since most shells pass them through literally.
+func ParseListTemplate(text string, file string) (*template.Template, error) {
+	if len(text) > 0 && len(file) > 0 {
+		return nil, fmt.Errorf("only one of --template and --template-file can be used")
+	}
+	if len(file) > 0 {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return template.New(file).Funcs(TemplateFuncs).Parse(string(contents))
+	}
+	return template.New("template").Funcs(TemplateFuncs).Parse(templateEscapes.Replace(text))
+}
+
+// WriteTemplate executes the template for each file, adding a newline after each one if the template doesn't end with
+// one. When once is set the template is instead executed a single time with the whole list of files.
+func WriteTemplate(w io.Writer, files []ExtractFile, tmpl *template.Template, once bool) error {
+	if once {
+		return tmpl.Execute(w, files)
+	}
+	for _, f := range files {
+		var out strings.Builder
+		err := tmpl.Execute(&out, f)
+		if err != nil {
+			return err
+		}
+		line := out.String()
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		_, err = io.WriteString(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,18 +4,26 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
 var (
-	ErrAuth            = errors.New("authentication error. please verify that the api key and secret are correct")
-	ErrNoExtract       = errors.New("the account associated with this api key has no files, please contact your technical account manager")
-	ErrServerError     = errors.New("server error, please contact your technical account manager")
-	ErrUnknownStatus   = errors.New("unexpected error retrieving extract info, try again and contact support if the problem persists")
-	ErrMissingAuth     = errors.New("config file requires api_key and api_secret")
-	ErrDefaultConfig   = errors.New("default values found, update the config file with your api key and secret")
-	ErrNoMatchingFiles = errors.New("no matching extracts found, please check your filters and try again")
+	ErrAuth              = errors.New("authentication error. please verify that the api key and secret are correct")
+	ErrNoExtract         = errors.New("the account associated with this api key has no files, please contact your technical account manager")
+	ErrServerError       = errors.New("server error, please contact your technical account manager")
+	ErrRateLimited       = errors.New("too many requests, wait a few minutes and try again")
+	ErrUnknownStatus     = errors.New("unexpected error retrieving extract info, try again and contact support if the problem persists")
+	ErrMissingAuth       = errors.New("config file requires api_key and api_secret, or set SPEEDTEST_API_KEY and SPEEDTEST_API_SECRET")
+	ErrDefaultConfig     = errors.New("default values found, update the config file with your api key and secret")
+	ErrNoMatchingFiles   = errors.New("no matching extracts found, please check your filters and try again")
+	ErrInterrupted       = errors.New("download interrupted")
+	ErrChecksumMismatch  = errors.New("checksum mismatch")
+	ErrNoDownloadedFiles = errors.New("none of the matching extracts have been downloaded, check your filters and the --use-file-hierarchy flag")
 )
 
 func contains(str string, list []string) bool {
@@ -27,6 +35,87 @@ func contains(str string, list []string) bool {
 	return false
 }
 
+// makeDirs creates root and then each directory of the relative path under it in turn
+func makeDirs(root string, rel string) error {
+	//did not use MkDirAll due to issues w/ umask filtering and dealing with diff platforms (windows)
+	dir := root
+	for _, p := range append([]string{""}, strings.Split(filepath.ToSlash(rel), "/")...) {
+		if p == "." {
+			continue
+		}
+		dir = filepath.Join(dir, p)
+		err := os.Mkdir(dir, 0700)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeDirPath creates dir along with any missing parents, starting from the nearest directory that already exists
+func makeDirPath(dir string) error {
+	root := filepath.Clean(dir)
+	for !fileExists(root) && filepath.Dir(root) != root {
+		root = filepath.Dir(root)
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return err
+	}
+	return makeDirs(root, rel)
+}
+
+// HumanSize formats a number of bytes using binary units, e.g. 1.5 GiB
+func HumanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// sizePattern matches a number followed by an optional binary unit, e.g. 500, 50M, 50MB or 1.5GiB
+var sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(?:([KMGTPE])(?:I?B)?|B)?$`)
+
+// ParseSize parses a size such as 50M or 1.5GiB into bytes. Units are binary (K is 1024 bytes) and a bare number is
+// bytes. Empty strings and "0" are zero.
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, nil
+	}
+	match := sizePattern.FindStringSubmatch(strings.ToUpper(value))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional unit such as 500K, 50M or 1.5GiB", value)
+	}
+	multiplier := int64(1)
+	if match[2] != "" {
+		multiplier = int64(1) << (10 * (strings.Index("KMGTPE", match[2]) + 1))
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	//zero is no limit wherever sizes are used, so a size that overflows or rounds down to nothing is an error
+	size := number * float64(multiplier)
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", value)
+	} else if number > 0 && int64(size) == 0 {
+		return 0, fmt.Errorf("size %q is less than a byte", value)
+	}
+	return int64(size), nil
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
 func GetInput(prompt string, allowedResponses []string, acceptFirstChar bool) string {
 	var resp string
 